@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+const (
+	contextPackage = protogen.GoImportPath("context")
+	rpcPackage     = protogen.GoImportPath("github.com/PumpkinSeed/npc/lib/rpc")
+)
+
+// warnings gets the diagnostics of the generation, protoc shows the stderr
+// of the plugin
+var warnings io.Writer = os.Stderr
+
+// generateFile generates the _npc.pb.go file of the services
+// returns nil if the file hasn't got any services
+func generateFile(gen *protogen.Plugin, file *protogen.File) *protogen.GeneratedFile {
+	if len(file.Services) == 0 {
+		return nil
+	}
+
+	g := gen.NewGeneratedFile(file.GeneratedFilenamePrefix+"_npc.pb.go", file.GoImportPath)
+	g.P("// Code generated by protoc-gen-npc. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+
+	for _, service := range file.Services {
+		generateSkipped(g, service)
+		generateServer(g, service)
+		generateClient(g, service)
+	}
+
+	return g
+}
+
+// generateServer generates the server interface and its rpc.AppServer adapter
+func generateServer(g *protogen.GeneratedFile, service *protogen.Service) {
+	serverName := service.GoName + "Server"
+	adapterName := unexport(service.GoName) + "AppServer"
+
+	// server interface
+	g.P("// ", serverName, " is the server API for the ", service.GoName, " service")
+	g.P("type ", serverName, " interface {")
+	for _, method := range unaryMethods(service) {
+		g.P(method.Comments.Leading,
+			method.GoName, "(", g.QualifiedGoIdent(contextPackage.Ident("Context")), ", *",
+			g.QualifiedGoIdent(method.Input.GoIdent), ") (*", g.QualifiedGoIdent(method.Output.GoIdent), ", error)")
+	}
+	g.P("}")
+	g.P()
+
+	// adapter constructor
+	g.P("// New", service.GoName, "AppServer adapts the ", serverName, " to rpc.AppServer")
+	g.P("func New", service.GoName, "AppServer(srv ", serverName, ") ", g.QualifiedGoIdent(rpcPackage.Ident("AppServer")), " {")
+	g.P("return &", adapterName, "{srv: srv}")
+	g.P("}")
+	g.P()
+
+	g.P("type ", adapterName, " struct {")
+	g.P("srv ", serverName)
+	g.P("}")
+	g.P()
+
+	// adapter dispatch
+	g.P("// Serve decodes the request, calls the method of the ", serverName, " and encodes its response")
+	g.P("func (s *", adapterName, ") Serve(ctx ", g.QualifiedGoIdent(contextPackage.Ident("Context")), ", method string, req []byte) ([]byte, error) {")
+	g.P("codec := ", g.QualifiedGoIdent(rpcPackage.Ident("ProtoCodec")), "{}")
+	g.P("if err := ", g.QualifiedGoIdent(rpcPackage.Ident("CheckContentType")), "(ctx, codec); err != nil {")
+	g.P("return nil, err")
+	g.P("}")
+	g.P("switch method {")
+	for _, method := range unaryMethods(service) {
+		g.P("case ", methodName(method), ":")
+		g.P("in := new(", g.QualifiedGoIdent(method.Input.GoIdent), ")")
+		g.P("if err := codec.Unmarshal(req, in); err != nil {")
+		g.P("return nil, ", g.QualifiedGoIdent(rpcPackage.Ident("Errorf")), "(", g.QualifiedGoIdent(rpcPackage.Ident("InvalidArgument")), ", \"invalid request of %s: %s\", method, err.Error())")
+		g.P("}")
+		g.P("out, err := s.srv.", method.GoName, "(ctx, in)")
+		g.P("if err != nil {")
+		g.P("return nil, err")
+		g.P("}")
+		g.P("return codec.Marshal(out)")
+	}
+	g.P("default:")
+	g.P("return nil, ", g.QualifiedGoIdent(rpcPackage.Ident("Errorf")), "(", g.QualifiedGoIdent(rpcPackage.Ident("Unimplemented")), ", \"method not found: %s\", method)")
+	g.P("}")
+	g.P("}")
+	g.P()
+}
+
+// generateClient generates the client stub over rpc.Caller
+func generateClient(g *protogen.GeneratedFile, service *protogen.Service) {
+	clientName := service.GoName + "Client"
+
+	g.P("// ", clientName, " is the client API for the ", service.GoName, " service")
+	g.P("type ", clientName, " struct {")
+	g.P("cc ", g.QualifiedGoIdent(rpcPackage.Ident("Caller")))
+	g.P("}")
+	g.P()
+
+	g.P("// New", clientName, " creates the client on top of the rpc.Caller")
+	g.P("func New", clientName, "(cc ", g.QualifiedGoIdent(rpcPackage.Ident("Caller")), ") *", clientName, " {")
+	g.P("return &", clientName, "{cc: cc}")
+	g.P("}")
+	g.P()
+
+	for _, method := range unaryMethods(service) {
+		g.P(method.Comments.Leading,
+			"func (c *", clientName, ") ", method.GoName, "(ctx ", g.QualifiedGoIdent(contextPackage.Ident("Context")),
+			", in *", g.QualifiedGoIdent(method.Input.GoIdent), ") (*", g.QualifiedGoIdent(method.Output.GoIdent), ", error) {")
+		g.P("out := new(", g.QualifiedGoIdent(method.Output.GoIdent), ")")
+		g.P("err := ", g.QualifiedGoIdent(rpcPackage.Ident("Invoke")), "(ctx, c.cc, ",
+			g.QualifiedGoIdent(rpcPackage.Ident("ProtoCodec")), "{}, ", methodName(method), ", in, out)")
+		g.P("if err != nil {")
+		g.P("return nil, err")
+		g.P("}")
+		g.P("return out, nil")
+		g.P("}")
+		g.P()
+	}
+}
+
+// generateSkipped notes the streaming methods of the service in the
+// generated file and warns about them, they aren't generated
+func generateSkipped(g *protogen.GeneratedFile, service *protogen.Service) {
+	var skipped bool
+	for _, method := range service.Methods {
+		if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+			name := service.GoName + "." + method.GoName
+			g.P("// ", name, " is not generated, the streaming methods are not supported")
+			fmt.Fprintf(warnings, "protoc-gen-npc: warning: %s: streaming method %s is skipped\n", service.Location.SourceFile, name)
+			skipped = true
+		}
+	}
+	if skipped {
+		g.P()
+	}
+}
+
+// unaryMethods returns the methods without client or server streaming,
+// the streaming methods are not supported
+func unaryMethods(service *protogen.Service) []*protogen.Method {
+	var methods []*protogen.Method
+	for _, method := range service.Methods {
+		if !method.Desc.IsStreamingClient() && !method.Desc.IsStreamingServer() {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// methodName returns the quoted "<Service>.<Method>" name of the method
+func methodName(method *protogen.Method) string {
+	return `"` + method.Parent.GoName + "." + method.GoName + `"`
+}
+
+// unexport lowercase the first letter of the name
+func unexport(name string) string {
+	if name == "" {
+		return name
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
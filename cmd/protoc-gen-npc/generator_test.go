@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+func TestGenerateFile(t *testing.T) {
+	var warned bytes.Buffer
+	warnings = &warned
+	defer func() { warnings = os.Stderr }()
+
+	gen := newPlugin(t, arithProto())
+
+	for _, f := range gen.Files {
+		if f.Generate {
+			if g := generateFile(gen, f); g == nil {
+				t.Fatal("file should be generated")
+			}
+		}
+	}
+
+	rsp := gen.Response()
+	if rsp.Error != nil {
+		t.Fatal(rsp.GetError())
+	}
+	if len(rsp.File) != 1 {
+		t.Fatalf("one file should be generated, instead of %d", len(rsp.File))
+	}
+	if name := rsp.File[0].GetName(); name != "example.com/arith/arith_npc.pb.go" {
+		t.Errorf("name should be example.com/arith/arith_npc.pb.go, instead of %s", name)
+	}
+
+	content := rsp.File[0].GetContent()
+	if _, err := parser.ParseFile(token.NewFileSet(), "arith_npc.pb.go", content, 0); err != nil {
+		t.Fatalf("generated code should be valid: %v\n%s", err, content)
+	}
+
+	for _, want := range []string{
+		"type ArithServer interface",
+		"Add(context.Context, *AddRequest) (*AddResponse, error)",
+		"func NewArithAppServer(srv ArithServer) rpc.AppServer",
+		"if err := rpc.CheckContentType(ctx, codec); err != nil {",
+		`case "Arith.Add":`,
+		"func NewArithClient(cc rpc.Caller) *ArithClient",
+		"func (c *ArithClient) Add(ctx context.Context, in *AddRequest) (*AddResponse, error)",
+		`rpc.Invoke(ctx, c.cc, rpc.ProtoCodec{}, "Arith.Add", in, out)`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("generated code should contain %q\n%s", want, content)
+		}
+	}
+	if strings.Contains(content, "Watch(") {
+		t.Errorf("streaming methods should be skipped\n%s", content)
+	}
+	if !strings.Contains(content, "// Arith.Watch is not generated") {
+		t.Errorf("skipped streaming method should be noted\n%s", content)
+	}
+	if w := warned.String(); !strings.Contains(w, "streaming method Arith.Watch is skipped") {
+		t.Errorf("skipped streaming method should be warned, instead of %q", w)
+	}
+}
+
+func TestGenerateFileWithoutServices(t *testing.T) {
+	fd := arithProto()
+	fd.Service = nil
+	gen := newPlugin(t, fd)
+
+	for _, f := range gen.Files {
+		if g := generateFile(gen, f); g != nil {
+			t.Error("file without services shouldn't be generated")
+		}
+	}
+}
+
+func newPlugin(t *testing.T, fd *descriptorpb.FileDescriptorProto) *protogen.Plugin {
+	gen, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{fd.GetName()},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{fd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gen
+}
+
+// arithProto describes the following file:
+//
+//	syntax = "proto3";
+//	package arith;
+//	option go_package = "example.com/arith";
+//	message AddRequest { int64 x = 1; int64 y = 2; }
+//	message AddResponse { int64 z = 1; }
+//	service Arith {
+//		rpc Add(AddRequest) returns (AddResponse);
+//		rpc Watch(AddRequest) returns (stream AddResponse);
+//	}
+func arithProto() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("arith/arith.proto"),
+		Package: proto.String("arith"),
+		Syntax:  proto.String("proto3"),
+		Options: &descriptorpb.FileOptions{
+			GoPackage: proto.String("example.com/arith"),
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("AddRequest"), Field: []*descriptorpb.FieldDescriptorProto{field("x", 1), field("y", 2)}},
+			{Name: proto.String("AddResponse"), Field: []*descriptorpb.FieldDescriptorProto{field("z", 1)}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Arith"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Add"), InputType: proto.String(".arith.AddRequest"), OutputType: proto.String(".arith.AddResponse")},
+				{Name: proto.String("Watch"), InputType: proto.String(".arith.AddRequest"), OutputType: proto.String(".arith.AddResponse"), ServerStreaming: proto.Bool(true)},
+			},
+		}},
+	}
+}
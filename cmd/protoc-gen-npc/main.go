@@ -0,0 +1,28 @@
+// protoc-gen-npc is a protoc plugin which generates npc server interfaces
+// and client stubs for the services of the .proto files
+//
+//	protoc --go_out=. --npc_out=. arith.proto
+//
+// for every service it generates the <Service>Server interface with the
+// New<Service>AppServer adapter to rpc.AppServer and the <Service>Client,
+// the bodies are protobuf encoded, the methods are called "<Service>.<Method>"
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+func main() {
+	protogen.Options{}.Run(func(gen *protogen.Plugin) error {
+		// the optional fields of proto3 are generated by protoc-gen-go, the
+		// services don't depend on them
+		gen.SupportedFeatures = uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)
+		for _, f := range gen.Files {
+			if f.Generate {
+				generateFile(gen, f)
+			}
+		}
+		return nil
+	})
+}
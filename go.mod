@@ -1,8 +1,10 @@
 module github.com/PumpkinSeed/npc
 
-go 1.12
+go 1.13
 
 require (
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049
 	github.com/nsqio/go-nsq v1.0.7
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.25.0
 )
@@ -16,7 +16,8 @@ type Config struct {
 	// NSQLookupdAddresses addresses of the NSQ Lookup daemons
 	NSQLookupdAddresses []string
 
-	// Concurrency amout of concurrent handlers of the consumer
+	// Concurrency amout of concurrent handlers of the consumer,
+	// the max-in-flight of the NSQ config raised to at least this
 	Concurrency int
 
 	// Logger of the consumer
@@ -34,10 +35,29 @@ func (c *Config) nsqConfig() *nsq.Config {
 	return c.NSQConfig
 }
 
+// concurrency returns the number of the handlers, at least one
+func (c *Config) concurrency() int {
+	if c.Concurrency < 1 {
+		return 1
+	}
+	return c.Concurrency
+}
+
+// consumerConfig returns a copy of the NSQConfig where the max-in-flight
+// is enough to keep all the concurrent handlers busy, the copy leaves
+// the NSQConfig shared with other consumers untouched
+func (c *Config) consumerConfig() *nsq.Config {
+	conf := *c.nsqConfig()
+	if conf.MaxInFlight < c.concurrency() {
+		conf.MaxInFlight = c.concurrency()
+	}
+	return &conf
+}
+
 // New creates and configures new nsq.Consumer.
 func New(cfg *Config, topic, channel string, handler nsq.Handler) (*nsq.Consumer, error) {
 	// get the consumer for the given topic
-	consumer, err := nsq.NewConsumer(topic, channel, cfg.nsqConfig())
+	consumer, err := nsq.NewConsumer(topic, channel, cfg.consumerConfig())
 	if err != nil {
 		return nil, err
 	}
@@ -45,10 +65,9 @@ func New(cfg *Config, topic, channel string, handler nsq.Handler) (*nsq.Consumer
 	// setup the logger
 	consumer.SetLogger(cfg.Logger, cfg.LogLevel)
 
-	consumer.AddHandler(handler)
-
-	// add concurrent handlers
-	//consumer.AddConcurrentHandlers(handler, cfg.Concurrency)
+	// add concurrent handlers, the handlers are the workers of a bounded
+	// pool, each of them processes one message at a time
+	consumer.AddConcurrentHandlers(handler, cfg.concurrency())
 
 	// based on the defined addresses connect to the NSQ cluster
 	if addrs := cfg.NSQLookupdAddresses; addrs != nil {
@@ -0,0 +1,51 @@
+package consumer
+
+import (
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestConsumerConfig(t *testing.T) {
+	nsqConf := nsq.NewConfig()
+	cfg := &Config{
+		NSQConfig:   nsqConf,
+		Concurrency: 8,
+	}
+
+	conf := cfg.consumerConfig()
+	if conf.MaxInFlight != 8 {
+		t.Errorf("MaxInFlight should be 8, instead of %d", conf.MaxInFlight)
+	}
+	if nsqConf.MaxInFlight != 1 {
+		t.Errorf("NSQConfig should be untouched, instead of MaxInFlight %d", nsqConf.MaxInFlight)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConsumerConfigMaxInFlight(t *testing.T) {
+	nsqConf := nsq.NewConfig()
+	nsqConf.MaxInFlight = 100
+	cfg := &Config{
+		NSQConfig:   nsqConf,
+		Concurrency: 8,
+	}
+
+	if conf := cfg.consumerConfig(); conf.MaxInFlight != 100 {
+		t.Errorf("MaxInFlight should be 100, instead of %d", conf.MaxInFlight)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	cfg := &Config{}
+	if n := cfg.concurrency(); n != 1 {
+		t.Errorf("concurrency should be 1, instead of %d", n)
+	}
+
+	cfg.Concurrency = 4
+	if n := cfg.concurrency(); n != 4 {
+		t.Errorf("concurrency should be 4, instead of %d", n)
+	}
+}
@@ -0,0 +1,168 @@
+package dedup
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/PumpkinSeed/npc/lib/rpc"
+)
+
+// compactThreshold is the number of the appended records after the file
+// is rewritten with the live entries only
+const compactThreshold = 10000
+
+// File is an rpc.DedupStore persisted into a file, so the server
+// remembers the served requests after a restart as well
+// the file is an append-only log of json records, compacted on open and
+// after every compactThreshold record, the writes are best effort, the
+// reply is stored in memory even if the write failed
+type File struct {
+	mem *Memory
+
+	path     string
+	file     *os.File
+	enc      *json.Encoder
+	appended int
+}
+
+var _ rpc.DedupStore = (*File)(nil)
+
+// record is a line of the file
+type record struct {
+	Key       string `json:"k"`
+	Reply     []byte `json:"r"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// OpenFile opens the store persisted in the file at path, creates it if
+// it doesn't exist
+func OpenFile(path string, ttl time.Duration) (*File, error) {
+	s := &File{
+		mem:  NewMemory(ttl),
+		path: path,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads the live records of the file into the memory
+// a truncated last record, which is written partially before a crash,
+// is skipped
+func (s *File) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("dedup file open failed: " + err.Error())
+	}
+	defer f.Close()
+
+	t := now()
+	dec := json.NewDecoder(f)
+	for {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errors.New("dedup file read failed: " + err.Error())
+		}
+
+		if expiresAt := time.Unix(0, r.ExpiresAt); t.Before(expiresAt) {
+			s.mem.set(r.Key, r.Reply, expiresAt)
+		}
+	}
+}
+
+// compact rewrites the file with the live entries and opens it for append
+// the caller must hold the lock of the memory
+func (s *File) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("dedup file create failed: " + err.Error())
+	}
+
+	t := now()
+	enc := json.NewEncoder(f)
+	for k, e := range s.mem.entries {
+		if !t.Before(e.expiresAt) {
+			continue
+		}
+		if err := enc.Encode(record{Key: k, Reply: e.reply, ExpiresAt: e.expiresAt.UnixNano()}); err != nil {
+			f.Close()
+			return errors.New("dedup file write failed: " + err.Error())
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.New("dedup file sync failed: " + err.Error())
+	}
+
+	// replace the old file and continue appending to the new one
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return errors.New("dedup file rename failed: " + err.Error())
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file = f
+	s.enc = enc
+	s.appended = 0
+	return nil
+}
+
+// Get returns the reply of the key, unless it's expired
+func (s *File) Get(key string) ([]byte, bool) {
+	return s.mem.Get(key)
+}
+
+// Set stores the reply of the key for the ttl and appends it to the file
+func (s *File) Set(key string, reply []byte) {
+	s.mem.Lock()
+	defer s.mem.Unlock()
+
+	expiresAt := now().Add(s.mem.ttl)
+	s.mem.set(key, reply, expiresAt)
+	if s.enc == nil {
+		return
+	}
+
+	// best effort, the reply stays in memory if the write fails
+	s.enc.Encode(record{Key: key, Reply: reply, ExpiresAt: expiresAt.UnixNano()})
+
+	s.appended++
+	if s.appended >= compactThreshold {
+		// retried only after the next compactThreshold records if failed
+		s.appended = 0
+		s.compact()
+	}
+}
+
+// Close closes the file, the store keeps working in memory only
+func (s *File) Close() error {
+	s.mem.Lock()
+	defer s.mem.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	s.enc = nil
+	return err
+}
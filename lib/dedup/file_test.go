@@ -0,0 +1,62 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replies")
+
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	s, err := OpenFile(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", []byte("reply a"))
+	clock = clock.Add(30 * time.Second)
+	s.Set("b", []byte("reply b"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated record at the end, like after a crash
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"k":"c","r":"cmVw`)
+	f.Close()
+
+	// a expires while the server restarts
+	clock = clock.Add(40 * time.Second)
+	s, err = OpenFile(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ok := s.Get("a"); ok {
+		t.Errorf("a should be expired")
+	}
+	if reply, ok := s.Get("b"); !ok || string(reply) != "reply b" {
+		t.Errorf("b should be reply b, instead of %s", reply)
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Errorf("truncated c shouldn't be loaded")
+	}
+	if l := s.mem.Len(); l != 1 {
+		t.Errorf("store should have only b, instead of %d entries", l)
+	}
+}
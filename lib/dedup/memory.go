@@ -0,0 +1,92 @@
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PumpkinSeed/npc/lib/rpc"
+)
+
+// DefaultTTL used if the ttl of the store isn't positive
+const DefaultTTL = 10 * time.Minute
+
+// now returns the current time, replaced by the tests
+var now = time.Now
+
+// Memory is an in-memory rpc.DedupStore, the stored replies expire after
+// the ttl, so it should be longer than the time the duplicates can arrive
+type Memory struct {
+	sync.Mutex
+
+	ttl     time.Duration
+	entries map[string]entry
+
+	// swept is the last time the expired entries were deleted
+	swept time.Time
+}
+
+var _ rpc.DedupStore = (*Memory)(nil)
+
+// entry is a stored reply with its expiration
+type entry struct {
+	reply     []byte
+	expiresAt time.Time
+}
+
+// NewMemory creates an in-memory store
+func NewMemory(ttl time.Duration) *Memory {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Memory{
+		ttl:     ttl,
+		entries: make(map[string]entry),
+		swept:   now(),
+	}
+}
+
+// Get returns the reply of the key, unless it's expired
+func (s *Memory) Get(key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !now().Before(e.expiresAt) {
+		return nil, false
+	}
+	return e.reply, true
+}
+
+// Set stores the reply of the key for the ttl
+func (s *Memory) Set(key string, reply []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(key, reply, now().Add(s.ttl))
+}
+
+// set stores the entry and deletes the expired ones time to time
+// the caller must hold the lock
+func (s *Memory) set(key string, reply []byte, expiresAt time.Time) {
+	t := now()
+	if t.Sub(s.swept) >= s.ttl {
+		for k, e := range s.entries {
+			if !t.Before(e.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+		s.swept = t
+	}
+
+	s.entries[key] = entry{reply: reply, expiresAt: expiresAt}
+}
+
+// Len returns the number of the stored replies, including the expired
+// ones not deleted yet
+func (s *Memory) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.entries)
+}
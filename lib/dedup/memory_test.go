@@ -0,0 +1,42 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	s := NewMemory(time.Minute)
+	if _, ok := s.Get("a"); ok {
+		t.Errorf("empty store shouldn't have a")
+	}
+
+	s.Set("a", []byte("reply"))
+	if reply, ok := s.Get("a"); !ok || string(reply) != "reply" {
+		t.Errorf("a should be reply, instead of %s", reply)
+	}
+
+	clock = clock.Add(time.Minute)
+	if _, ok := s.Get("a"); ok {
+		t.Errorf("a should be expired")
+	}
+
+	// the next set deletes the expired entries
+	s.Set("b", nil)
+	if l := s.Len(); l != 1 {
+		t.Errorf("store should have 1 entry, instead of %d", l)
+	}
+	if _, ok := s.Get("b"); !ok {
+		t.Errorf("b should be stored without reply")
+	}
+}
+
+func TestMemoryDefaultTTL(t *testing.T) {
+	if s := NewMemory(0); s.ttl != DefaultTTL {
+		t.Errorf("ttl should be %v, instead of %v", DefaultTTL, s.ttl)
+	}
+}
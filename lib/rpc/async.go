@@ -0,0 +1,241 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// Call is an asynchronous call, it's done when Done receives it
+type Call struct {
+	// Topic is the request topic, empty means the request topic of the
+	// client, only the Batch uses it
+	Topic string
+
+	// Method is the name of the called method
+	Method string
+
+	// Request is the body of the request
+	Request []byte
+
+	// Reply is the body of the reply
+	Reply []byte
+
+	// Header is the header of the reply
+	Header Header
+
+	// Error is the error of the call, the status of the server or the
+	// error of the transport
+	Error error
+
+	// Done receives the call when it's done
+	Done chan *Call
+
+	ctx      context.Context
+	delay    time.Duration
+	timer    *time.Timer
+	watcher  *watcher
+	callback func(*Call)
+}
+
+// watcher completes the calls of a context when it's done, the calls of
+// the same context share it, so there is no goroutine per call
+type watcher struct {
+	ctx   context.Context
+	done  <-chan struct{}
+	calls map[uint32]struct{}
+
+	// idle is closed when all the calls completed before the context
+	idle chan struct{}
+}
+
+// done signals the completion of the call
+func (call *Call) done() {
+	if call.callback != nil {
+		call.callback(call)
+		return
+	}
+
+	// the channel has room for the call, the caller made sure of it
+	select {
+	case call.Done <- call:
+	default:
+	}
+}
+
+// Go calls the method asynchronously, the Done channel of the returned
+// call receives it when it's done, if done is nil a new channel is
+// allocated, otherwise it must be buffered
+// no goroutine is started for the call, the deadline of the context is
+// enforced by a timer, the calls of a cancellable context share a goroutine
+// watching it, the servers are told about the cancelled calls
+func (c *Client) Go(ctx context.Context, typ string, req []byte, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+
+	call := &Call{Method: typ, Request: req, Done: done, ctx: ctx}
+	c.start(call)
+	return call
+}
+
+// GoFunc calls the method asynchronously, the callback is called with the
+// call when it's done, on the goroutine of the consumer, the timer or the
+// watcher of the context, so it must not block
+func (c *Client) GoFunc(ctx context.Context, typ string, req []byte, callback func(*Call)) *Call {
+	call := &Call{Method: typ, Request: req, ctx: ctx, callback: callback}
+	c.start(call)
+	return call
+}
+
+// start sends the request of the call, the reply completes it by the
+// HandleMessage
+func (c *Client) start(call *Call) {
+	if err := call.ctx.Err(); err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+
+	// the interceptors rejecting the call or the failed publish complete
+	// the call right away
+	id, eReq := c.register(call)
+	if err := c.send(call.ctx, c.reqTopic, call.delay, eReq); err != nil {
+		if call, ok := c.takeCall(id); ok {
+			call.Error = err
+			call.done()
+		}
+	}
+}
+
+// register subscribes the call and returns its correlation id and its
+// request, which is sent through the interceptors
+func (c *Client) register(call *Call) (uint32, *Envelope) {
+	eReq := c.request(call.ctx, call.Method, call.Request)
+	if call.delay > 0 {
+		eReq.setDelay(call.delay)
+	}
+	id := c.correlationID()
+	eReq.CorrelationID = id
+
+	// the timer is armed under the lock, so the reply can't complete the
+	// call before it's set, the timeout of a scheduled call starts after
+	// its delay
+	c.Lock()
+	c.calls[id] = call
+	if d, ok := call.ctx.Deadline(); ok {
+		call.timer = time.AfterFunc(time.Until(d)+call.delay, func() {
+			if call, ok := c.takeCall(id); ok {
+				call.Error = context.DeadlineExceeded
+				call.done()
+			}
+		})
+	}
+	if done := call.ctx.Done(); done != nil {
+		w, ok := c.watchers[done]
+		if !ok {
+			w = &watcher{ctx: call.ctx, done: done, calls: make(map[uint32]struct{}), idle: make(chan struct{})}
+			c.watchers[done] = w
+			go c.watch(w)
+		}
+		w.calls[id] = struct{}{}
+		call.watcher = w
+	}
+	c.Unlock()
+
+	return id, eReq
+}
+
+// finish completes the call by the reply
+func (call *Call) finish(rsp *Envelope) {
+	// the context is cancelled while the call waited for the reply, the
+	// deadline of a scheduled call is enforced only by its timer
+	if err := call.ctx.Err(); err != nil && (call.delay == 0 || err != context.DeadlineExceeded) {
+		call.Error = err
+		call.done()
+		return
+	}
+
+	collectReplyHeader(call.ctx, rsp.Header)
+	call.Reply = rsp.Body
+	call.Header = rsp.Header
+	call.Error = rsp.Err()
+	call.done()
+}
+
+// takeCall unsubscribes the call, ok is false if it's already done
+func (c *Client) takeCall(id uint32) (*Call, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	call, ok := c.calls[id]
+	if !ok {
+		return nil, false
+	}
+	delete(c.calls, id)
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+
+	// the last call of the watcher stops it
+	if w := call.watcher; w != nil {
+		delete(w.calls, id)
+		if len(w.calls) == 0 && c.watchers[w.done] == w {
+			delete(c.watchers, w.done)
+			close(w.idle)
+		}
+	}
+	return call, true
+}
+
+// watch completes the calls of the watcher with the error of the context
+// when it's done, the cancelled calls are cancelled on the servers too
+func (c *Client) watch(w *watcher) {
+	select {
+	case <-w.idle:
+		return
+	case <-w.done:
+	}
+	err := w.ctx.Err()
+
+	c.Lock()
+	if c.watchers[w.done] == w {
+		delete(c.watchers, w.done)
+	}
+	ids := make([]uint32, 0, len(w.calls))
+	calls := make([]*Call, 0, len(w.calls))
+	for id := range w.calls {
+		call := c.calls[id]
+
+		// the deadline of a scheduled call is enforced by its timer
+		call.watcher = nil
+		if err == context.DeadlineExceeded && call.delay > 0 {
+			continue
+		}
+
+		delete(c.calls, id)
+		if call.timer != nil {
+			call.timer.Stop()
+		}
+		ids = append(ids, id)
+		calls = append(calls, call)
+	}
+	w.calls = nil
+	c.Unlock()
+
+	for i, call := range calls {
+		// the server drops the expired requests itself, but it has to be
+		// told about the cancellation
+		if err == context.Canceled {
+			topic := call.Topic
+			if topic == "" {
+				topic = c.reqTopic
+			}
+			c.cancel(topic, &Envelope{Method: call.Method, ReplyTo: c.rspTopic, CorrelationID: ids[i], Format: c.format})
+		}
+
+		call.Error = err
+		call.done()
+	}
+}
@@ -0,0 +1,166 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestGo(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan *Call, 200)
+	for i := 0; i < 200; i++ {
+		c.Go(ctx, "Echo", []byte(fmt.Sprintf("msg-%d", i)), done)
+	}
+
+	for i := 0; i < 200; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if string(call.Reply) != string(call.Request) {
+			t.Errorf("reply should be %s, instead of %s", call.Request, call.Reply)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.calls) != 0 {
+		t.Errorf("calls should be empty, instead of %d", len(c.calls))
+	}
+	if len(c.watchers) != 0 {
+		t.Errorf("watchers should be empty, instead of %d", len(c.watchers))
+	}
+}
+
+func TestGoCancel(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+
+	// the server never replies, the cancel messages are counted
+	var cancelled int32
+	lb.subscribe("request", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+	lb.subscribe(ControlTopic("request"), handlerFunc(func(e *Envelope) {
+		if e.Kind == KindCancel {
+			atomic.AddInt32(&cancelled, 1)
+		}
+	}, nsq.HandlerFunc(func(*nsq.Message) error { return nil })))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *Call, 50)
+	for i := 0; i < 50; i++ {
+		c.Go(ctx, "Echo", nil, done)
+	}
+	cancel()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case call := <-done:
+			if call.Error != context.Canceled {
+				t.Errorf("call should be cancelled, instead of %v", call.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("cancelled call should be done")
+		}
+	}
+
+	// the cancel messages are delivered concurrently
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&cancelled); n != 50 {
+		t.Errorf("server should get 50 cancel messages, instead of %d", n)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.calls) != 0 || len(c.watchers) != 0 {
+		t.Errorf("calls and watchers should be empty, instead of %d, %d", len(c.calls), len(c.watchers))
+	}
+}
+
+func TestGoFunc(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		c.GoFunc(ctx, "Echo", []byte(fmt.Sprintf("msg-%d", i)), func(call *Call) {
+			defer wg.Done()
+			if call.Error != nil {
+				t.Error(call.Error)
+				return
+			}
+
+			mu.Lock()
+			replies[string(call.Reply)] = true
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if len(replies) != 100 {
+		t.Errorf("every call should get its reply, instead of %d", len(replies))
+	}
+}
+
+func TestGoTimeout(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &blockingServer{started: make(chan struct{}), done: make(chan error, 1)}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	call := <-c.Go(ctx, "Block", nil, nil).Done
+	if call.Error != context.DeadlineExceeded {
+		t.Errorf("call should time out, instead of %v", call.Error)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.calls) != 0 {
+		t.Errorf("calls should be empty, instead of %d", len(c.calls))
+	}
+}
+
+func TestGoUnavailable(t *testing.T) {
+	c := NewClient(newLoopback(), "request", "response")
+
+	call := <-c.Go(context.Background(), "Echo", nil, nil).Done
+	if CodeOf(call.Error) != Unavailable {
+		t.Errorf("call without topic should be Unavailable, instead of %v", call.Error)
+	}
+}
+
+func TestGoUnbuffered(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("unbuffered done channel should panic")
+		}
+	}()
+
+	c := NewClient(newLoopback(), "request", "response")
+	c.Go(context.Background(), "Echo", nil, make(chan *Call))
+}
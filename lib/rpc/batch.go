@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"context"
+)
+
+// maxBatchBody is the size limit of a multi-publish, below the default
+// max-body-size of nsqd
+var maxBatchBody = 4 * 1024 * 1024
+
+// Batch sends the calls in as few publishes as possible and waits until
+// all of them are done, the requests of the same topic are published at
+// once if the publisher is a MultiPublisher, every call is tracked by its
+// own correlation id, the replies and the errors are in the calls, the
+// calls still open when the context is done fail with its error, the
+// client interceptors get nil reply for them
+// the empty Topic of a call means the request topic of the client
+func (c *Client) Batch(ctx context.Context, calls []*Call) {
+	done := make(chan *Call, len(calls))
+
+	// group the requests by topic, in the order of the calls
+	var topics []string
+	ids := make(map[string][]uint32)
+	bodies := make(map[string][][]byte)
+	for _, call := range calls {
+		call.ctx, call.Done, call.callback = ctx, done, nil
+		if err := ctx.Err(); err != nil {
+			call.Error = err
+			call.done()
+			continue
+		}
+
+		topic := call.Topic
+		if topic == "" {
+			topic = c.reqTopic
+		}
+		if _, ok := ids[topic]; !ok {
+			topics = append(topics, topic)
+			ids[topic] = nil
+		}
+
+		// the requests go through the interceptors one by one, the end of
+		// the chain collects them, the batch is published after the chain,
+		// so the interceptors can't see the publish errors
+		id, eReq := c.register(call)
+		_, err := c.intercept(ctx, eReq, func(ctx context.Context, eReq *Envelope) (*Envelope, error) {
+			eReq.Compress(c.compression)
+			ids[topic] = append(ids[topic], id)
+			bodies[topic] = append(bodies[topic], eReq.Encode())
+			return nil, nil
+		})
+		if err != nil {
+			if call, ok := c.takeCall(id); ok {
+				call.Error = err
+				call.done()
+			}
+		}
+	}
+
+	// the calls not published are done right away
+	for _, topic := range topics {
+		if failed, err := c.publishAll(topic, bodies[topic]); err != nil {
+			for _, id := range ids[topic][failed:] {
+				if call, ok := c.takeCall(id); ok {
+					call.Error = Errorf(Unavailable, "nsq publish failed: %s", err.Error())
+					call.done()
+				}
+			}
+		}
+	}
+
+	// every call is signalled once, the ones still open when the context
+	// is done are failed here, the rest are signalled by their completer
+	for received := 0; received < len(calls); received++ {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			for _, topic := range topics {
+				for _, id := range ids[topic] {
+					if call, ok := c.takeCall(id); ok {
+						call.Error = ctx.Err()
+						call.done()
+					}
+				}
+			}
+			<-done
+		}
+	}
+}
+
+// publishAll publishes the bodies to the topic, in chunks by multi-publish
+// if it's supported, it returns the index of the first body not published
+// with the error
+func (c *Client) publishAll(topic string, bodies [][]byte) (int, error) {
+	mp, ok := c.publisher.(MultiPublisher)
+	if !ok {
+		for i, body := range bodies {
+			if err := c.publisher.Publish(topic, body); err != nil {
+				return i, err
+			}
+		}
+		return len(bodies), nil
+	}
+
+	for start := 0; start < len(bodies); {
+		// a chunk has at least one body, even if it's over the limit
+		end, size := start+1, len(bodies[start])
+		for end < len(bodies) && size+len(bodies[end]) <= maxBatchBody {
+			size += len(bodies[end])
+			end++
+		}
+
+		var err error
+		if end-start == 1 {
+			err = c.publisher.Publish(topic, bodies[start])
+		} else {
+			err = mp.MultiPublish(topic, bodies[start:end])
+		}
+		if err != nil {
+			return start, err
+		}
+		start = end
+	}
+	return len(bodies), nil
+}
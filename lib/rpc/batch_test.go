@@ -0,0 +1,152 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestBatch(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("other", NewServer(context.Background(), shardServer{"", Errorf(NotFound, "not here")}, lb))
+	lb.subscribe("response", c)
+
+	var calls []*Call
+	for i := 0; i < 50; i++ {
+		call := &Call{Method: "Echo", Request: []byte(fmt.Sprintf("msg-%d", i))}
+		if i%5 == 0 {
+			call.Topic = "other"
+		}
+		calls = append(calls, call)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Batch(ctx, calls)
+
+	for i, call := range calls {
+		if i%5 == 0 {
+			if CodeOf(call.Error) != NotFound {
+				t.Errorf("call %d should be NotFound, instead of %v", i, call.Error)
+			}
+			continue
+		}
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if string(call.Reply) != string(call.Request) {
+			t.Errorf("reply should be %s, instead of %s", call.Request, call.Reply)
+		}
+	}
+
+	if n := atomic.LoadInt32(&lb.multiPublished); n != 2 {
+		t.Errorf("batch should be published in 2 multi-publishes, instead of %d", n)
+	}
+}
+
+func TestBatchChunks(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	limit := maxBatchBody
+	defer func() { maxBatchBody = limit }()
+
+	var calls []*Call
+	for i := 0; i < 10; i++ {
+		calls = append(calls, &Call{Method: "Echo", Request: make([]byte, 100)})
+	}
+	maxBatchBody = 5 * len(c.request(context.Background(), "Echo", calls[0].Request).Encode())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Batch(ctx, calls)
+
+	for _, call := range calls {
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if n := atomic.LoadInt32(&lb.multiPublished); n < 2 {
+		t.Errorf("batch should be split into chunks, instead of %d multi-publish", n)
+	}
+}
+
+func TestBatchUnavailable(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(publishOnly{lb}, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	calls := []*Call{
+		{Method: "Echo", Request: []byte("a")},
+		{Topic: "missing", Method: "Echo"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Batch(ctx, calls)
+
+	if calls[0].Error != nil || string(calls[0].Reply) != "a" {
+		t.Errorf("first call should be a, instead of %s, %v", calls[0].Reply, calls[0].Error)
+	}
+	if CodeOf(calls[1].Error) != Unavailable {
+		t.Errorf("call of missing topic should be Unavailable, instead of %v", calls[1].Error)
+	}
+	if n := atomic.LoadInt32(&lb.multiPublished); n != 0 {
+		t.Errorf("multi-publish shouldn't be used, instead of %d", n)
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+
+	// the server never replies
+	lb.subscribe("request", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+	lb.subscribe("response", c)
+
+	calls := []*Call{{Method: "Echo"}, {Method: "Echo"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	returned := make(chan struct{})
+	go func() {
+		c.Batch(ctx, calls)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("batch should return when the context is cancelled")
+	}
+
+	for i, call := range calls {
+		if call.Error != context.Canceled {
+			t.Errorf("call %d should be cancelled, instead of %v", i, call.Error)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.calls) != 0 {
+		t.Errorf("calls should be empty, instead of %d", len(c.calls))
+	}
+}
+
+// publishOnly hides the MultiPublish of the publisher
+type publishOnly struct {
+	p Publisher
+}
+
+func (p publishOnly) Publish(topic string, body []byte) error {
+	return p.p.Publish(topic, body)
+}
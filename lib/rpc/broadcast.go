@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+// BroadcastOptions determines when the Broadcast stops collecting the
+// replies, without Count and Quorum it collects until the deadline
+type BroadcastOptions struct {
+	// Count stops after this many replies, zero means no limit
+	Count int
+
+	// Quorum stops after this many successful replies, zero means no quorum
+	Quorum int
+}
+
+// collector gathers the replies of a broadcast
+type collector struct {
+	mu      sync.Mutex
+	replies []*Envelope
+	ok      int
+	notify  chan struct{}
+}
+
+// add appends the reply
+func (col *collector) add(rsp *Envelope) {
+	col.mu.Lock()
+	col.replies = append(col.replies, rsp)
+	if rsp.Err() == nil {
+		col.ok++
+	}
+	col.mu.Unlock()
+
+	select {
+	case col.notify <- struct{}{}:
+	default:
+	}
+}
+
+// reached returns true if the replies satisfy the options
+func (col *collector) reached(opts BroadcastOptions) bool {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	return (opts.Count > 0 && len(col.replies) >= opts.Count) ||
+		(opts.Quorum > 0 && col.ok >= opts.Quorum)
+}
+
+// Broadcast sends the request once to all the servers consuming the
+// request topic on different channels and collects their replies until
+// the count or the quorum of the options reached, or the deadline
+// the replies are returned even if the options aren't satisfied, with
+// DeadlineExceeded error, the errors of the servers are in the replies
+func (c *Client) Broadcast(ctx context.Context, typ string, req []byte, opts BroadcastOptions) ([]*Envelope, error) {
+	return c.BroadcastTopic(ctx, c.reqTopic, typ, req, opts)
+}
+
+// BroadcastTopic is the same as the Broadcast, but it gets the topic to
+// send the request
+func (c *Client) BroadcastTopic(ctx context.Context, reqTopic, typ string, req []byte, opts BroadcastOptions) ([]*Envelope, error) {
+	// without deadline it would never end
+	if _, ok := ctx.Deadline(); !ok && opts.Count <= 0 && opts.Quorum <= 0 {
+		return nil, Errorf(InvalidArgument, "broadcast needs deadline, count or quorum")
+	}
+
+	eReq := c.request(ctx, typ, req)
+	eReq.CorrelationID = c.correlationID()
+
+	// the collector stays subscribed until the end, so every reply of
+	// the correlation id is kept
+	col := &collector{notify: make(chan struct{}, 1)}
+	c.addCollector(eReq.CorrelationID, col)
+	defer c.removeCollector(eReq.CorrelationID)
+
+	if err := c.send(ctx, reqTopic, 0, eReq); err != nil {
+		return nil, err
+	}
+
+	// wait until the options are satisfied or the context is done
+	var err error
+	for done := col.reached(opts); !done; {
+		select {
+		case <-col.notify:
+			done = col.reached(opts)
+		case <-ctx.Done():
+			done = true
+
+			// the deadline is the normal end without count and quorum
+			switch {
+			case ctx.Err() == context.Canceled:
+				err = ctx.Err()
+			case opts.Count > 0 || opts.Quorum > 0:
+				err = Errorf(DeadlineExceeded, "broadcast of %s not satisfied until the deadline", typ)
+			}
+		}
+	}
+
+	// the servers still working on it aren't needed any more
+	if ctx.Err() != context.DeadlineExceeded {
+		c.cancel(reqTopic, eReq)
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	return col.replies, err
+}
+
+// addCollector subscribes the collector to the replies
+func (c *Client) addCollector(id uint32, col *collector) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.collectors[id] = col
+}
+
+// collector returns the collector of the correlation id
+func (c *Client) collector(id uint32) (*collector, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	col, ok := c.collectors[id]
+	return col, ok
+}
+
+// removeCollector unsubscribes the collector
+func (c *Client) removeCollector(id uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.collectors, id)
+}
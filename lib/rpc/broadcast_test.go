@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestBroadcast(t *testing.T) {
+	c := newShards(shardServer{"a", nil}, shardServer{"b", nil}, shardServer{"c", nil})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	replies, err := c.Broadcast(ctx, "Name", nil, BroadcastOptions{Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := replyBodies(replies); len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Errorf("every shard should reply, instead of %v", names)
+	}
+	if len(c.collectors) != 0 {
+		t.Errorf("collectors should be empty, instead of %d", len(c.collectors))
+	}
+}
+
+func TestBroadcastQuorum(t *testing.T) {
+	failed := Errorf(Unavailable, "shard down")
+	c := newShards(shardServer{"a", failed}, shardServer{"b", nil}, shardServer{"c", nil})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	replies, err := c.Broadcast(ctx, "Name", nil, BroadcastOptions{Quorum: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ok int
+	for _, rsp := range replies {
+		if rsp.Err() == nil {
+			ok++
+		}
+	}
+	if ok != 2 {
+		t.Errorf("quorum should be 2 successful replies, instead of %d", ok)
+	}
+}
+
+func TestBroadcastDeadline(t *testing.T) {
+	c := newShards(shardServer{"a", nil}, shardServer{"b", nil})
+
+	// without count and quorum the deadline is the normal end
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	replies, err := c.Broadcast(ctx, "Name", nil, BroadcastOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 {
+		t.Errorf("both shards should reply, instead of %d", len(replies))
+	}
+
+	// the count can't be reached
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	replies, err = c.Broadcast(ctx, "Name", nil, BroadcastOptions{Count: 3})
+	if CodeOf(err) != DeadlineExceeded {
+		t.Errorf("broadcast should fail with DeadlineExceeded, instead of %v", err)
+	}
+	if len(replies) != 2 {
+		t.Errorf("the replies should be returned anyway, instead of %d", len(replies))
+	}
+
+	if _, err := c.Broadcast(context.Background(), "Name", nil, BroadcastOptions{}); CodeOf(err) != InvalidArgument {
+		t.Errorf("endless broadcast should be InvalidArgument, instead of %v", err)
+	}
+}
+
+// newShards connects a client to servers consuming the same request topic
+// on different channels
+func newShards(shards ...shardServer) *Client {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("response", c)
+
+	var servers []*Server
+	for _, shard := range shards {
+		servers = append(servers, NewServer(context.Background(), shard, lb))
+	}
+	lb.subscribe("request", nsq.HandlerFunc(func(m *nsq.Message) error {
+		for i, s := range servers {
+			go deliver(s, newMessage(uint64(i), m.Body))
+		}
+		return nil
+	}))
+	lb.subscribe(ControlTopic("request"), nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+
+	return c
+}
+
+// replyBodies returns the sorted bodies of the replies
+func replyBodies(replies []*Envelope) []string {
+	var bodies []string
+	for _, rsp := range replies {
+		bodies = append(bodies, string(rsp.Body))
+	}
+	sort.Strings(bodies)
+	return bodies
+}
+
+// shardServer replies with its name or the error
+type shardServer struct {
+	name string
+	err  error
+}
+
+func (s shardServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []byte(s.name), nil
+}
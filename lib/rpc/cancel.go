@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+)
+
+// inflight stores the cancel functions of the requests in progress by the
+// reply topic and the correlation id
+type inflight map[string]context.CancelFunc
+
+// inflightKey identifies the request of the reply topic, empty if the
+// request can't be cancelled
+func inflightKey(replyTo string, correlationID uint32) string {
+	if replyTo == "" || correlationID == 0 {
+		return ""
+	}
+	return replyTo + ":" + strconv.FormatUint(uint64(correlationID), 10)
+}
+
+// track registers the cancel function of the request until the returned
+// function called
+func (s *Server) track(req *Envelope, cancel context.CancelFunc) func() {
+	key := inflightKey(req.ReplyTo, req.CorrelationID)
+	if key == "" {
+		return func() {}
+	}
+
+	s.inflightMu.Lock()
+	s.inflight[key] = cancel
+	s.inflightMu.Unlock()
+
+	return func() {
+		s.inflightMu.Lock()
+		delete(s.inflight, key)
+		s.inflightMu.Unlock()
+	}
+}
+
+// cancel cancels the context of the request in progress, the cancellation
+// of an unknown request is ignored, it's served by an other instance or
+// it's already done
+func (s *Server) cancel(req *Envelope) {
+	key := inflightKey(req.ReplyTo, req.CorrelationID)
+
+	s.inflightMu.Lock()
+	cancel, ok := s.inflight[key]
+	s.inflightMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// SetCancellation turns on or off the cancel messages, on by default
+// the servers consume them from the ControlTopic of the request topic
+func (c *Client) SetCancellation(enabled bool) {
+	c.noCancel = !enabled
+}
+
+// cancel tells the servers that nobody waits for the reply of the request
+// best effort, the server finishes the request if the message is lost
+func (c *Client) cancel(reqTopic string, eReq *Envelope) {
+	if c.noCancel {
+		return
+	}
+
+	msg := &Envelope{
+		Kind:          KindCancel,
+		Method:        eReq.Method,
+		ReplyTo:       eReq.ReplyTo,
+		CorrelationID: eReq.CorrelationID,
+		Format:        eReq.Format,
+	}
+	c.publisher.Publish(ControlTopic(reqTopic), msg.Encode())
+}
@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestControlTopic(t *testing.T) {
+	if topic := ControlTopic("request"); topic != "request_control#ephemeral" {
+		t.Errorf("control topic should be request_control#ephemeral, instead of %s", topic)
+	}
+
+	long := ControlTopic(string(make([]byte, 100)))
+	if len(long) > maxNameLength {
+		t.Errorf("control topic should be at most %d long, instead of %d", maxNameLength, len(long))
+	}
+}
+
+func TestBinaryKind(t *testing.T) {
+	e := &Envelope{Kind: KindCancel, ReplyTo: "response", CorrelationID: 7, Format: FormatBinary}
+
+	e2, err := Decode(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2.Kind != KindCancel || e2.CorrelationID != 7 {
+		t.Errorf("cancel of 7 should be decoded, instead of %+v", e2)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &blockingServer{started: make(chan struct{}), done: make(chan error, 1)}
+	s := NewServer(context.Background(), srv, lb)
+
+	// the request is delivered with a known delegate, so it tells how
+	// the server responded to the message
+	d := &delegate{}
+	handled := make(chan struct{})
+	lb.subscribe("request", nsq.HandlerFunc(func(m *nsq.Message) error {
+		msg := newMessage(1, m.Body)
+		msg.Delegate = d
+		deliver(s, msg)
+		close(handled)
+		return nil
+	}))
+	lb.subscribe(ControlTopic("request"), s)
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-srv.started
+		cancel()
+	}()
+
+	if _, err := c.Do(ctx, "Block", nil); err != context.Canceled {
+		t.Errorf("call should be cancelled, instead of %v", err)
+	}
+
+	select {
+	case err := <-srv.done:
+		if err != context.Canceled {
+			t.Errorf("server context should be cancelled, instead of %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server should stop the cancelled request")
+	}
+
+	<-handled
+	if atomic.LoadInt32(&d.finished) != 1 || atomic.LoadInt32(&d.requeued) != 0 {
+		t.Errorf("cancelled request should be finished, instead of %+v", d)
+	}
+}
+
+// blockingServer blocks until the request context is done
+type blockingServer struct {
+	started chan struct{}
+	done    chan error
+}
+
+func (b *blockingServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	close(b.started)
+	<-ctx.Done()
+	b.done <- ctx.Err()
+	return nil, ctx.Err()
+}
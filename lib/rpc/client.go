@@ -12,11 +12,53 @@ import (
 	"github.com/nsqio/go-nsq"
 )
 
+// Caller sends a request and waits for the response, the Client implements
+// it, the typed calls and the generated clients are built on top of it
+// returns the response body, or the application error as *Status or the
+// transport error
+type Caller interface {
+	Do(ctx context.Context, typ string, req []byte) ([]byte, error)
+}
+
+// CallerFunc is an adapter to use an ordinary function as Caller
+type CallerFunc func(ctx context.Context, typ string, req []byte) ([]byte, error)
+
+// Do calls f(ctx, typ, req)
+func (f CallerFunc) Do(ctx context.Context, typ string, req []byte) ([]byte, error) {
+	return f(ctx, typ, req)
+}
+
+// Invoke is the typed call over the Caller, the req encoded by the codec
+// as request body and the response body decoded into the rsp, which should
+// be a pointer, the application error returned as *Status
+func Invoke(ctx context.Context, cc Caller, codec Codec, typ string, req interface{}, rsp interface{}) error {
+	// declare the codec, so the server decodes and replies with the same
+	ctx = WithContentType(ctx, codec.ContentType())
+
+	reqBuf, err := codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rspBuf, err := cc.Do(ctx, typ, reqBuf)
+	if err != nil {
+		return err
+	}
+
+	// nothing to decode, if the caller don't care about the response
+	// or the server didn't send any
+	if rsp == nil || len(rspBuf) == 0 {
+		return nil
+	}
+
+	return codec.Unmarshal(rspBuf, rsp)
+}
+
 // Client rpc client side
 type Client struct {
 	// publisher is the nsq producer which responsible
 	// for produce the message passed in the Call method
-	publisher *nsq.Producer
+	publisher Publisher
 
 	// reqTopic stores the request topic name
 	reqTopic string
@@ -24,6 +66,24 @@ type Client struct {
 	// rspTopic stores the response topic name
 	rspTopic string
 
+	// format of the request envelopes
+	format Format
+
+	// compression threshold of the request bodies
+	compression int
+
+	// interceptors wrap every call
+	interceptors []ClientInterceptor
+
+	// retryPolicies by method, the empty method is the default
+	retryPolicies map[string]RetryPolicy
+
+	// noCancel turns off the cancel messages
+	noCancel bool
+
+	// sharedReplies is true if other clients consume the reply topic too
+	sharedReplies bool
+
 	// msgNo determine the id of the message
 	// mostly unique and random to identify the
 	// the message and it's response
@@ -32,6 +92,21 @@ type Client struct {
 	// subscribers ???
 	subscribers map[uint32]chan *Envelope
 
+	// streams are the subscribers of the streamed replies
+	streams map[uint32]*ClientStream
+
+	// collectors are the subscribers of the broadcasts
+	collectors map[uint32]*collector
+
+	// calls are the subscribers of the asynchronous calls
+	calls map[uint32]*Call
+
+	// watchers complete the asynchronous calls of the done contexts
+	watchers map[<-chan struct{}]*watcher
+
+	// gapTimeout is the time the streams wait for a missing frame
+	gapTimeout time.Duration
+
 	// add mutex to handle critical points
 	sync.Mutex
 }
@@ -39,7 +114,7 @@ type Client struct {
 // NewClient creates new rpc client
 // publisher will be used for sending request on reqTopic
 // rspTopic will be send in each message envelope, server will reply on that topic
-func NewClient(publisher *nsq.Producer, reqTopic, rspTopic string) *Client {
+func NewClient(publisher Publisher, reqTopic, rspTopic string) *Client {
 	// rand seed provide a seed mechanism for the msgNo to get a unique identifier
 	rand.Seed(time.Now().UnixNano())
 
@@ -52,9 +127,42 @@ func NewClient(publisher *nsq.Producer, reqTopic, rspTopic string) *Client {
 		rspTopic:    rspTopic,
 		msgNo:       rand.Uint32(), //@todo uint64
 		subscribers: make(map[uint32]chan *Envelope),
+		streams:     make(map[uint32]*ClientStream),
+		collectors:  make(map[uint32]*collector),
+		calls:       make(map[uint32]*Call),
+		watchers:    make(map[<-chan struct{}]*watcher),
+		gapTimeout:  defaultGapTimeout,
 	}
 }
 
+// SetSharedReplyTopic tells that other clients consume the reply topic
+// too, e.g. on their own channels, so the replies without subscriber are
+// finished quietly instead of returning error
+func (c *Client) SetSharedReplyTopic(shared bool) {
+	c.sharedReplies = shared
+}
+
+// SetFormat sets the wire format of the requests, the server replies
+// in the same format, the default is FormatJSON which every server
+// understands, it should be called before the first call
+func (c *Client) SetFormat(f Format) {
+	c.format = f
+}
+
+// SetCompression turns on the snappy compression of the request bodies
+// at least threshold bytes long, zero turns it off
+func (c *Client) SetCompression(threshold int) {
+	c.compression = threshold
+}
+
+// Use appends the interceptors to the chain wrapping every call, the
+// calls which don't wait for the reply inside the chain pass nil reply to
+// it, the first one is the outermost, it should be called before the first
+// call
+func (c *Client) Use(interceptors ...ClientInterceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
 // HandleMessage accepts incoming server reponses
 // HandleMessage client side handler, if there is a consumed message the
 // HandleMessage will handle it and do the necessery steps because of the
@@ -79,22 +187,44 @@ func (c *Client) HandleMessage(m *nsq.Message) error {
 		return errors.New("envelope unpack failed" + err.Error())
 	}
 
+	// the asynchronous calls are completed right here
+	if call, found := c.takeCall(rsp.CorrelationID); found {
+		call.finish(rsp)
+		return nil
+	}
+
 	// find subscriber waiting for response, the list of the subscribers stored
 	// and identified with the correlation ID
+	// the timed out calls are unsubscribed, their late replies are
+	// finished below and reported as not found, like any unknown reply
 	if s, found := c.get(rsp.CorrelationID); found {
 
 		// if subscription had been found than pass the response into
-		if s != nil {
-			s <- rsp
-		}
-		// when s == nil, means that request timed out, nobody is waiting for response
-		// nothing to do in that case
+		s <- rsp
+		return nil
+	}
+
+	// the frames of the streamed replies, the stream stays subscribed
+	// until its end
+	if s, found := c.stream(rsp.CorrelationID); found {
+		s.deliver(rsp)
+		return nil
+	}
+
+	// the replies of the broadcasts, every server replies
+	if col, found := c.collector(rsp.CorrelationID); found {
+		col.add(rsp)
 		return nil
 	}
 
 	// fin provide the finish of the handle and close the message
 	fin()
 
+	// the replies of the other clients on the shared topic are expected
+	if c.sharedReplies {
+		return nil
+	}
+
 	// there wasn't subscriber for the message number
 	return fmt.Errorf("subscriber not found for %d", rsp.CorrelationID)
 }
@@ -108,33 +238,98 @@ func (c *Client) Call(ctx context.Context, typ string, req []byte) ([]byte, stri
 // CallTopic is the core body of the Call function, it gets the topic to send the
 // request and return the exactly same as the Call
 func (c *Client) CallTopic(ctx context.Context, reqTopic, typ string, req []byte) ([]byte, string, error) {
+	rsp, err := c.invoke(ctx, reqTopic, c.request(ctx, typ, req))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// return the response body and the error of the response,
+	// nil as the third error
+	return rsp.Body, rsp.Error, nil
+}
+
+// Do is the same as the Call, but the application error of the server
+// returned as *Status error, so it can be inspected with errors.As
+func (c *Client) Do(ctx context.Context, typ string, req []byte) ([]byte, error) {
+	return c.DoTopic(ctx, c.reqTopic, typ, req)
+}
+
+// DoTopic is the same as the Do, but it gets the topic to send the request
+func (c *Client) DoTopic(ctx context.Context, reqTopic, typ string, req []byte) ([]byte, error) {
+	rsp, err := c.invoke(ctx, reqTopic, c.request(ctx, typ, req))
+	if err != nil {
+		return nil, err
+	}
+	if err := rsp.Err(); err != nil {
+		return nil, err
+	}
+
+	return rsp.Body, nil
+}
+
+// request creates the request Envelope of the call
+func (c *Client) request(ctx context.Context, typ string, req []byte) *Envelope {
 	// the request body will be the Envelope encoded version
-	// the correlactionID generated based on the msgNo
-	correlationID := c.correlationID()
 	eReq := &Envelope{
-		Method:        typ,
-		ReplyTo:       c.rspTopic,
-		CorrelationID: correlationID,
-		Body:          req,
+		Method:         typ,
+		ReplyTo:        c.rspTopic,
+		IdempotencyKey: idempotencyKey(ctx),
+		ContentType:    ContentTypeFromContext(ctx),
+		Format:         c.format,
+		Header:         outgoingHeader(ctx),
+		Body:           req,
 	}
 
 	// setup deadline, if it's defined in the context
 	// the request ExpiresAt ship it to the server as
 	// well
 	if d, ok := ctx.Deadline(); ok {
-		eReq.ExpiresAt = d.Unix()
+		eReq.setDeadline(time.Now(), d)
+	}
+
+	return eReq
+}
+
+// invoke sends the request through the interceptor chain, the retries
+// happen inside the chain
+func (c *Client) invoke(ctx context.Context, reqTopic string, eReq *Envelope) (*Envelope, error) {
+	return c.intercept(ctx, eReq, func(ctx context.Context, eReq *Envelope) (*Envelope, error) {
+		return c.retry(ctx, reqTopic, eReq)
+	})
+}
+
+// intercept calls the invoker through the interceptor chain
+func (c *Client) intercept(ctx context.Context, eReq *Envelope, invoker Invoker) (*Envelope, error) {
+	if len(c.interceptors) == 0 {
+		return invoker(ctx, eReq)
 	}
 
+	return chainClient(c.interceptors, invoker)(ctx, eReq)
+}
+
+// roundTrip sends the request to the topic and waits for the reply
+func (c *Client) roundTrip(ctx context.Context, reqTopic string, eReq *Envelope) (*Envelope, error) {
+	// compress the large bodies, after the interceptors saw the original
+	eReq.Compress(c.compression)
+
+	// the correlactionID generated based on the msgNo
+	correlationID := c.correlationID()
+	eReq.CorrelationID = correlationID
+
 	// create the channel of the response, it will be a Envelope type
 	// add this channel to the list of the sibscribers with the
 	// correlationID as the subscriber identifier
-	rspCh := make(chan *Envelope)
+	// the channel is buffered, so the HandleMessage never blocks on a
+	// caller which gave up right after the response arrived
+	rspCh := make(chan *Envelope, 1)
 	c.add(correlationID, rspCh)
 
 	// send request to the server through the nsq publisher
 	// defined in the client initializer
 	if err := c.publisher.Publish(reqTopic, eReq.Encode()); err != nil {
-		return nil, "", errors.New("nsq publish failed" + err.Error())
+		// nobody will answer, so the subscriber is dropped immediately
+		c.remove(correlationID)
+		return nil, Errorf(Unavailable, "nsq publish failed: %s", err.Error())
 	}
 
 	// wait for the response in the previously created channel
@@ -142,14 +337,20 @@ func (c *Client) CallTopic(ctx context.Context, reqTopic, typ string, req []byte
 	// or context timeout/cancelation
 	select {
 	case rsp := <-rspCh:
-		// return the response body and the error of the response,
-		// nil as the third error
-		return rsp.Body, rsp.Error, nil
+		// pass the header of the reply to the caller if it's interested
+		collectReplyHeader(ctx, rsp.Header)
+		return rsp, nil
 	case <-ctx.Done():
-		// timeout removes the subscriber
+		// remove the subscriber on timeout
 		// returns the context error
-		c.timeout(correlationID)
-		return nil, "", ctx.Err()
+		c.remove(correlationID)
+
+		// the server drops the expired requests itself, but it has to be
+		// told about the cancellation
+		if ctx.Err() == context.Canceled {
+			c.cancel(reqTopic, eReq)
+		}
+		return nil, ctx.Err()
 	}
 }
 
@@ -193,15 +394,13 @@ func (c *Client) get(id uint32) (chan *Envelope, bool) {
 	return ch, ok
 }
 
-// timeout do the necessary steps on case of context timeout
-func (c *Client) timeout(id uint32) {
+// remove the subscriber without leaving any trace behind, it's used on
+// timeout as well to avoid the memory leaks, the servers don't reply to the
+// expired and cancelled requests, so nothing would delete it later
+func (c *Client) remove(id uint32) {
 	// lock the critical section to avoid race condition
 	c.Lock()
 	defer c.Unlock()
 
-	// if the subscriber is there it's delete from the list
-	// because of the timeout to avoid the memory leaks
-	if _, found := c.subscribers[id]; found {
-		c.subscribers[id] = nil
-	}
+	delete(c.subscribers, id)
 }
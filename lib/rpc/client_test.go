@@ -1,7 +1,12 @@
 package rpc
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 )
@@ -46,6 +51,107 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestCallConcurrent(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := fmt.Sprintf("msg-%d", i)
+			rsp, rspErr, err := c.Call(ctx, "Echo", []byte(req))
+			if err != nil || rspErr != "" {
+				t.Errorf("call %d failed: %v %s", i, err, rspErr)
+				return
+			}
+			if string(rsp) != req {
+				t.Errorf("response should be %s, instead of %s", req, rsp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(c.subscribers) != 0 {
+		t.Errorf("subscribers should be empty, instead of %d", len(c.subscribers))
+	}
+}
+
+func TestCallPublishFailed(t *testing.T) {
+	c := NewClient(newLoopback(), "request", "response")
+
+	_, _, err := c.Call(context.Background(), "Echo", []byte("msg"))
+	if err == nil {
+		t.Error("error should be returned when the publish fails")
+	}
+	if len(c.subscribers) != 0 {
+		t.Errorf("subscribers should be empty, instead of %d", len(c.subscribers))
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+
+	// the server never replies
+	lb.subscribe("request", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+	lb.subscribe("response", c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, _, err := c.Call(ctx, "Echo", nil); err != context.DeadlineExceeded {
+				t.Errorf("call should time out, instead of %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.subscribers) != 0 {
+		t.Errorf("subscribers should be empty, instead of %d", len(c.subscribers))
+	}
+}
+
+func TestSharedReplyTopic(t *testing.T) {
+	c := NewClient(newLoopback(), "request", "response")
+	reply := (&Envelope{CorrelationID: c.correlationID() + 100}).Encode()
+
+	if err := c.HandleMessage(newMessage(1, reply)); err == nil {
+		t.Error("reply without subscriber should fail on the private topic")
+	}
+
+	// the reply of an other client on the shared topic
+	c.SetSharedReplyTopic(true)
+	m := newMessage(2, reply)
+	if err := c.HandleMessage(m); err != nil {
+		t.Errorf("reply of an other client should be dropped quietly, instead of %v", err)
+	}
+	if d := m.Delegate.(*delegate); atomic.LoadInt32(&d.finished) != 1 {
+		t.Error("reply of an other client should be finished")
+	}
+}
+
+// echoServer replies with the request body
+type echoServer struct{}
+
+func (echoServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	return req, nil
+}
+
 /*
 	The following tests requires local nsq
 */
@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of the built-in codecs
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeGob      = "application/gob"
+)
+
+var (
+	// codecs stores the registered codecs by content type
+	codecs   = make(map[string]Codec)
+	codecsMu sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtoCodec{})
+	RegisterCodec(MsgpackCodec{})
+	RegisterCodec(GobCodec{})
+}
+
+// Codec encodes and decodes the request and response bodies of the
+// typed calls and the Registry, the content type of the codec travels
+// in the Envelope, so the server can decode the request by it
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RegisterCodec makes the codec available by its content type, it
+// replaces the previously registered codec of the same content type
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.ContentType()] = c
+}
+
+// GetCodec returns the registered codec of the content type
+func GetCodec(contentType string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+// contentTypeKey is the context key of the content type
+type contentTypeKey struct{}
+
+// WithContentType attaches the content type of the body to the context,
+// on the client side the request Envelope gets it, on the server side
+// the AppServer finds the content type of the request in it
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// ContentTypeFromContext returns the content type attached to the context
+// empty if the sender didn't declare it
+func ContentTypeFromContext(ctx context.Context) string {
+	ct, _ := ctx.Value(contentTypeKey{}).(string)
+	return ct
+}
+
+// CheckContentType returns error if the request declared a content type
+// other than the codec's one
+func CheckContentType(ctx context.Context, c Codec) error {
+	if ct := ContentTypeFromContext(ctx); ct != "" && ct != c.ContentType() {
+		return Errorf(Unimplemented, "unsupported content type: %s", ct)
+	}
+	return nil
+}
+
+// JSONCodec encodes the bodies with encoding/json, this is the default
+type JSONCodec struct{}
+
+// ContentType returns application/json
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Marshal encodes v into JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtoCodec encodes the bodies with protobuf, the values must be
+// proto.Message implementations
+type ProtoCodec struct{}
+
+// ContentType returns application/protobuf
+func (ProtoCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// Marshal encodes v into protobuf wire format
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("proto codec: value is not a proto.Message")
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes the protobuf data into v
+func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.New("proto codec: value is not a proto.Message")
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MsgpackCodec encodes the bodies with MessagePack
+type MsgpackCodec struct{}
+
+// ContentType returns application/msgpack
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+// Marshal encodes v into MessagePack
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal decodes the MessagePack data into v
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// GobCodec encodes the bodies with encoding/gob, every body carries its
+// own type information, so it's the most verbose one
+type GobCodec struct{}
+
+// ContentType returns application/gob
+func (GobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+// Marshal encodes v into gob
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the gob data into v
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
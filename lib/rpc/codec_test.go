@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestJSONCodec(t *testing.T) {
+	var c Codec = JSONCodec{}
+
+	buf, err := c.Marshal(&ArithRequest{X: 1, Y: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != `{"X":1,"Y":2}` {
+		t.Errorf(`encoded should be {"X":1,"Y":2}, instead of %s`, buf)
+	}
+
+	var req ArithRequest
+	if err := c.Unmarshal(buf, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.X != 1 || req.Y != 2 {
+		t.Errorf("decoded should be {1 2}, instead of %v", req)
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	var c Codec = ProtoCodec{}
+
+	buf, err := c.Marshal(wrapperspb.String("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v wrapperspb.StringValue
+	if err := c.Unmarshal(buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GetValue() != "msg" {
+		t.Errorf("decoded should be msg, instead of %s", v.GetValue())
+	}
+
+	if _, err := c.Marshal(&ArithRequest{}); err == nil {
+		t.Error("non proto.Message value should fail")
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, c := range []Codec{JSONCodec{}, MsgpackCodec{}, GobCodec{}} {
+		buf, err := c.Marshal(&ArithRequest{X: 1, Y: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var req ArithRequest
+		if err := c.Unmarshal(buf, &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.X != 1 || req.Y != 2 {
+			t.Errorf("%s decoded should be {1 2}, instead of %v", c.ContentType(), req)
+		}
+	}
+}
+
+func TestGetCodec(t *testing.T) {
+	for _, ct := range []string{ContentTypeJSON, ContentTypeProtobuf, ContentTypeMsgpack, ContentTypeGob} {
+		c, ok := GetCodec(ct)
+		if !ok {
+			t.Errorf("%s should be registered", ct)
+			continue
+		}
+		if c.ContentType() != ct {
+			t.Errorf("content type should be %s, instead of %s", ct, c.ContentType())
+		}
+	}
+
+	if _, ok := GetCodec("application/xml"); ok {
+		t.Error("application/xml shouldn't be registered")
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	ctx := context.Background()
+	if err := CheckContentType(ctx, ProtoCodec{}); err != nil {
+		t.Errorf("request without content type should be accepted: %v", err)
+	}
+
+	ctx = WithContentType(ctx, ContentTypeProtobuf)
+	if err := CheckContentType(ctx, ProtoCodec{}); err != nil {
+		t.Errorf("protobuf request should be accepted: %v", err)
+	}
+
+	ctx = WithContentType(ctx, ContentTypeJSON)
+	if err := CheckContentType(ctx, ProtoCodec{}); err == nil {
+		t.Error("json request should be rejected")
+	}
+}
@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+// Compress compresses the body with snappy if it's at least threshold
+// bytes long, zero or negative threshold turns off the compression
+// the header flags the compressed body, so the Decode decompress it
+func (m *Envelope) Compress(threshold int) {
+	if threshold <= 0 || m.Compressed || len(m.Body) < threshold {
+		return
+	}
+
+	m.Body = snappy.Encode(nil, m.Body)
+	m.Compressed = true
+}
+
+// decompress restores the compressed body and clears the flag
+func (m *Envelope) decompress() error {
+	if !m.Compressed {
+		return nil
+	}
+
+	body, err := snappy.Decode(nil, m.Body)
+	if err != nil {
+		return errors.New("body decompression failed: " + err.Error())
+	}
+
+	m.Body = body
+	m.Compressed = false
+	return nil
+}
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("compress "), 100)
+
+	e := &Envelope{Body: body}
+	e.Compress(0)
+	if e.Compressed {
+		t.Error("zero threshold shouldn't compress")
+	}
+
+	e.Compress(len(body) + 1)
+	if e.Compressed {
+		t.Error("body under the threshold shouldn't be compressed")
+	}
+
+	e.Compress(len(body))
+	if !e.Compressed || len(e.Body) >= len(body) {
+		t.Errorf("body should be compressed, length %d", len(e.Body))
+	}
+}
+
+func TestDecodeCompressed(t *testing.T) {
+	body := bytes.Repeat([]byte("compress "), 100)
+
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		e := &Envelope{Method: "put", Format: f, Body: body}
+		e.Compress(1)
+
+		e2, err := Decode(e.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e2.Compressed {
+			t.Error("decoded envelope shouldn't be flagged as compressed")
+		}
+		if !bytes.Equal(e2.Body, body) {
+			t.Errorf("body should be decompressed, instead of %q", e2.Body)
+		}
+	}
+}
+
+func TestDecodeCorruptCompressed(t *testing.T) {
+	e := &Envelope{Method: "put", Compressed: true, Body: []byte{0xff, 0xff, 0xff}}
+
+	if _, err := Decode(e.Encode()); err == nil {
+		t.Error("corrupt compressed body should fail")
+	}
+}
+
+func TestCallCompressed(t *testing.T) {
+	body := bytes.Repeat([]byte("compress "), 100)
+
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	c.SetCompression(64)
+	srv := NewServer(context.Background(), echoServer{}, lb)
+	srv.SetCompression(64)
+
+	// both the request and the reply should travel compressed
+	sizes := make(chan int, 2)
+	peek := func(m []byte) {
+		if e, err := decode(m); err == nil && e.Compressed {
+			sizes <- len(e.Body)
+		}
+	}
+	lb.subscribe("request", rawHandlerFunc(peek, srv))
+	lb.subscribe("response", rawHandlerFunc(peek, c))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, _, err := c.Call(ctx, "Echo", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, body) {
+		t.Errorf("response should be the request body, instead of %q", rsp)
+	}
+
+	for i := 0; i < 2; i++ {
+		if size := <-sizes; size >= len(body) {
+			t.Errorf("compressed body should be shorter than %d, instead of %d", len(body), size)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// header keys of the dead letters
+const (
+	// DeadLetterReason is the header of the reason, why the message is
+	// dead, one of the Reason constants
+	DeadLetterReason = "dead-letter-reason"
+
+	// DeadLetterError is the header of the error of the message if any
+	DeadLetterError = "dead-letter-error"
+
+	// DeadLetterAttempts is the header of the delivery attempts of the
+	// message
+	DeadLetterAttempts = "dead-letter-attempts"
+)
+
+// reasons of the dead letters
+const (
+	// ReasonUndecodable is the reason of the messages which aren't
+	// envelopes
+	ReasonUndecodable = "undecodable"
+
+	// ReasonExpired is the reason of the requests which expired before
+	// they were served
+	ReasonExpired = "expired"
+
+	// ReasonExhausted is the reason of the messages which were attempted
+	// more than the max attempts
+	ReasonExhausted = "exhausted"
+)
+
+// SetDeadLetter sets the topic where the dead messages are republished
+// instead of dropping them: the undecodable ones, the expired requests and
+// the messages delivered more than maxAttempts times, zero maxAttempts
+// turns off the attempts check of the server, the messages which the
+// consumer gives up by its MaxAttempts are republished anyway
+// the dead letter is a JSON envelope with the reason in its header and the
+// original message in its body, so it can be replayed as it is
+func (s *Server) SetDeadLetter(topic string, maxAttempts uint16) {
+	s.deadLetterTopic = topic
+	s.maxAttempts = maxAttempts
+}
+
+// exhausted returns true if the message was delivered more times than the
+// max attempts
+func (s *Server) exhausted(m *nsq.Message) bool {
+	return s.deadLetterTopic != "" && s.maxAttempts > 0 && m.Attempts > s.maxAttempts
+}
+
+// deadLetter republishes the message to the dead-letter topic, the req is
+// nil if the message isn't decodable, it's a no-op without topic
+func (s *Server) deadLetter(m *nsq.Message, req *Envelope, reason string, cause error) error {
+	if s.deadLetterTopic == "" {
+		return nil
+	}
+
+	// the method of the request helps to find the dead letters
+	e := &Envelope{
+		Header: Header{
+			DeadLetterReason:   reason,
+			DeadLetterAttempts: strconv.Itoa(int(m.Attempts)),
+		},
+		Body: m.Body,
+	}
+	if req != nil {
+		e.Method = req.Method
+	}
+	if cause != nil {
+		e.Header[DeadLetterError] = cause.Error()
+	}
+
+	if err := s.producer.Publish(s.deadLetterTopic, e.Encode()); err != nil {
+		return errors.New("dead letter publish failed: " + err.Error())
+	}
+	return nil
+}
+
+// LogFailedMessage is called by the consumer when it gives up the message
+// after its MaxAttempts, the message is republished to the dead-letter
+// topic, best effort, the consumer finishes the message anyway, so the
+// failed publish is only logged
+func (s *Server) LogFailedMessage(m *nsq.Message) {
+	req, _ := decode(m.Body)
+	if err := s.deadLetter(m, req, ReasonExhausted, nil); err != nil && s.logger != nil {
+		s.logger.Output(2, fmt.Sprintf("msg %s lost after %d attempts: %s", m.ID[:], m.Attempts, err.Error()))
+	}
+}
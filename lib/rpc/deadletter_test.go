@@ -0,0 +1,135 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestDeadLetterUndecodable(t *testing.T) {
+	s, letters := newDeadLetterServer(&notifiedServer{}, 0)
+
+	m := newMessage(1, []byte("garbage"))
+	if err := s.HandleMessage(m); err == nil {
+		t.Error("undecodable message should fail")
+	}
+	if d := m.Delegate.(*delegate); atomic.LoadInt32(&d.finished) != 1 {
+		t.Error("dead message should be finished")
+	}
+
+	e := <-letters
+	if e.Header[DeadLetterReason] != ReasonUndecodable || e.Header[DeadLetterError] == "" {
+		t.Errorf("dead letter should be undecodable with error, instead of %v", e.Header)
+	}
+	if string(e.Body) != "garbage" {
+		t.Errorf("dead letter should carry the message, instead of %s", e.Body)
+	}
+}
+
+func TestDeadLetterExpired(t *testing.T) {
+	s, letters := newDeadLetterServer(&notifiedServer{}, 0)
+
+	req := &Envelope{Method: "Get", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	if err := s.HandleMessage(newMessage(1, req.Encode())); err == nil {
+		t.Error("expired request should fail")
+	}
+
+	e := <-letters
+	if e.Header[DeadLetterReason] != ReasonExpired || e.Method != "Get" {
+		t.Errorf("dead letter should be expired Get, instead of %s %v", e.Method, e.Header)
+	}
+	if string(e.Body) != string(req.Encode()) {
+		t.Error("dead letter should carry the original request")
+	}
+}
+
+func TestDeadLetterExhausted(t *testing.T) {
+	srv := &notifiedServer{received: make(chan *RequestInfo, 1)}
+	s, letters := newDeadLetterServer(srv, 3)
+	body := (&Envelope{Method: "Expire"}).Encode()
+
+	m := newMessage(1, body)
+	m.Attempts = 3
+	if err := s.HandleMessage(m); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newMessage(2, body)
+	m.Attempts = 4
+	if err := s.HandleMessage(m); err == nil {
+		t.Error("exhausted message should fail")
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Errorf("server should be called only within the attempts, instead of %d times", calls)
+	}
+
+	e := <-letters
+	if e.Header[DeadLetterReason] != ReasonExhausted || e.Header[DeadLetterAttempts] != "4" {
+		t.Errorf("dead letter should be exhausted after 4 attempts, instead of %v", e.Header)
+	}
+
+	// the consumer gives up the message by its own max attempts
+	s.LogFailedMessage(m)
+	if e := <-letters; e.Header[DeadLetterReason] != ReasonExhausted || e.Method != "Expire" {
+		t.Errorf("failed message should be exhausted Expire, instead of %s %v", e.Method, e.Header)
+	}
+}
+
+func TestDeadLetterPublishFailed(t *testing.T) {
+	s := NewServer(context.Background(), &notifiedServer{}, newLoopback())
+	s.SetDeadLetter("dead", 0)
+
+	// the dead-letter topic has no subscriber, the message is requeued
+	m := newMessage(1, []byte("garbage"))
+	deliver(s, m)
+	if d := m.Delegate.(*delegate); atomic.LoadInt32(&d.finished) != 0 || atomic.LoadInt32(&d.requeued) != 1 {
+		t.Errorf("message should be requeued, instead of %+v", d)
+	}
+}
+
+func TestDeadLetterLost(t *testing.T) {
+	s := NewServer(context.Background(), &notifiedServer{}, newLoopback())
+	s.SetDeadLetter("dead", 3)
+	logger := &recordLogger{}
+	s.SetLogger(logger)
+
+	// the dead-letter topic has no subscriber, the consumer finishes the
+	// message anyway, so it's logged
+	s.LogFailedMessage(newMessage(1, []byte("garbage")))
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "lost") {
+		t.Errorf("lost dead letter should be logged, instead of %v", logger.lines)
+	}
+}
+
+// recordLogger records the logged lines
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Output(calldepth int, s string) error {
+	l.lines = append(l.lines, s)
+	return nil
+}
+
+// newDeadLetterServer creates a server with dead-letter topic, the dead
+// letters are decoded into the channel
+func newDeadLetterServer(srv AppServer, maxAttempts uint16) (*Server, chan *Envelope) {
+	lb := newLoopback()
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDeadLetter("dead", maxAttempts)
+
+	letters := make(chan *Envelope, 2)
+	lb.subscribe("dead", nsq.HandlerFunc(func(m *nsq.Message) error {
+		e, err := Decode(m.Body)
+		if err != nil {
+			return err
+		}
+		letters <- e
+		return nil
+	}))
+	return s, letters
+}
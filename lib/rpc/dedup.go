@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"github.com/nsqio/go-nsq"
+)
+
+// DedupStore remembers the replies of the served requests, so the server
+// replays the reply of a duplicated request instead of serving it again
+// the implementations must be safe for concurrent use
+type DedupStore interface {
+	// Get returns the reply stored by the key, ok is false if the request
+	// of the key wasn't served yet
+	Get(key string) (reply []byte, ok bool)
+
+	// Set stores the reply by the key
+	Set(key string, reply []byte)
+}
+
+// SetDedupStore sets the store of the served requests, the duplicates
+// of the successfully served requests get the stored reply, the failed
+// ones are served again so they can be retried, the duplicates of the
+// requests in progress are requeued, nil turns it off
+func (s *Server) SetDedupStore(store DedupStore) {
+	s.dedup = store
+}
+
+// dedupKey identifies the request across the redeliveries and the retries
+// the idempotency key of the call, or the nsq message id, which is the same
+// for the redeliveries only, the correlation ids of different clients can
+// collide, empty if the dedup is off
+func (s *Server) dedupKey(m *nsq.Message, req *Envelope) string {
+	switch {
+	case s.dedup == nil, req.Kind != KindRequest:
+		return ""
+	case req.IdempotencyKey != "":
+		return "i:" + req.IdempotencyKey
+	}
+	return "m:" + string(m.ID[:])
+}
+
+// reserve marks the key in progress, ok is false if an other delivery of
+// the request is being served, the unreserve unmarks it
+func (s *Server) reserve(key string) (unreserve func(), ok bool) {
+	if key == "" {
+		return func() {}, true
+	}
+
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+
+	if _, found := s.reserved[key]; found {
+		return nil, false
+	}
+	s.reserved[key] = struct{}{}
+
+	return func() {
+		s.inflightMu.Lock()
+		delete(s.reserved, key)
+		s.inflightMu.Unlock()
+	}, true
+}
+
+// served returns the stored reply of the request, nil reply means the
+// request served without reply, ok is false if it's not served yet
+func (s *Server) served(key string) (*Envelope, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	buf, ok := s.dedup.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if len(buf) == 0 {
+		return nil, true
+	}
+
+	// serve it again rather than reply with a broken one
+	rsp, err := Decode(buf)
+	if err != nil {
+		return nil, false
+	}
+	return rsp, true
+}
+
+// remember stores the encoded reply of the served request
+func (s *Server) remember(key string, reply []byte) {
+	if key == "" {
+		return
+	}
+	if reply == nil {
+		reply = []byte{}
+	}
+
+	s.dedup.Set(key, reply)
+}
@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestDedupKey(t *testing.T) {
+	s := NewServer(context.Background(), echoServer{}, newLoopback())
+	m := newMessage(1, nil)
+	if key := s.dedupKey(m, &Envelope{IdempotencyKey: "key-1"}); key != "" {
+		t.Errorf("key should be empty without store, instead of %s", key)
+	}
+
+	s.SetDedupStore(&mapStore{})
+	cases := []struct {
+		req *Envelope
+		key string
+	}{
+		{&Envelope{IdempotencyKey: "key-1", ReplyTo: "response", CorrelationID: 1}, "i:key-1"},
+		{&Envelope{ReplyTo: "response", CorrelationID: 1}, "m:" + string(m.ID[:])},
+		{&Envelope{Kind: KindStream, ReplyTo: "response", CorrelationID: 1}, ""},
+	}
+	for _, c := range cases {
+		if key := s.dedupKey(m, c.req); key != c.key {
+			t.Errorf("key should be %q, instead of %q", c.key, key)
+		}
+	}
+}
+
+func TestDedupReplay(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{}
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDedupStore(&mapStore{})
+	lb.subscribe("request", s)
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = WithIdempotencyKey(ctx, "key-1")
+
+	for i := 0; i < 3; i++ {
+		rsp, err := c.Do(ctx, "Echo", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rsp) != "hello" {
+			t.Errorf("response should be hello, instead of %s", rsp)
+		}
+	}
+
+	if keys := srv.keys(); len(keys) != 1 {
+		t.Errorf("server should serve the request once, instead of %d", len(keys))
+	}
+}
+
+func TestDedupRedelivery(t *testing.T) {
+	lb := newLoopback()
+	lb.subscribe("response", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+
+	srv := &flakyServer{}
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDedupStore(&mapStore{})
+
+	// the same message delivered twice, like after a requeue
+	body := (&Envelope{Method: "Echo", ReplyTo: "response", CorrelationID: 7}).Encode()
+	for i := 0; i < 2; i++ {
+		if err := s.HandleMessage(newMessage(1, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := srv.keys(); len(keys) != 1 {
+		t.Errorf("server should serve the message once, instead of %d", len(keys))
+	}
+}
+
+func TestDedupOverlapping(t *testing.T) {
+	lb := newLoopback()
+	lb.subscribe("response", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+
+	srv := &slowServer{started: make(chan struct{}, 1), open: make(chan struct{})}
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDedupStore(&mapStore{})
+
+	body := (&Envelope{Method: "Echo", ReplyTo: "response", IdempotencyKey: "key-1", CorrelationID: 7}).Encode()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.HandleMessage(newMessage(1, body))
+	}()
+	<-srv.started
+
+	// the duplicate arrives while the first delivery is being served
+	m := newMessage(2, body)
+	if err := s.HandleMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if d := m.Delegate.(*delegate); atomic.LoadInt32(&d.requeued) != 1 {
+		t.Error("duplicate in progress should be requeued")
+	}
+
+	close(srv.open)
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	// the requeued duplicate gets the stored reply
+	if err := s.HandleMessage(newMessage(3, body)); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Errorf("server should serve the request once, instead of %d", calls)
+	}
+}
+
+func TestDedupCorrelationCollision(t *testing.T) {
+	lb := newLoopback()
+	lb.subscribe("response", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+
+	srv := &flakyServer{}
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDedupStore(&mapStore{})
+
+	// two clients on the shared reply topic with the same correlation id
+	for i, body := range []string{"first", "second"} {
+		req := &Envelope{Method: "Echo", ReplyTo: "response", CorrelationID: 7, Body: []byte(body)}
+		if err := s.HandleMessage(newMessage(uint64(i+1), req.Encode())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := srv.keys(); len(keys) != 2 {
+		t.Errorf("both requests should be served, instead of %d", len(keys))
+	}
+}
+
+func TestDedupFailed(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{failures: 1, code: Unavailable}
+	s := NewServer(context.Background(), srv, lb)
+	s.SetDedupStore(&mapStore{})
+	lb.subscribe("request", s)
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = WithIdempotencyKey(ctx, "key-1")
+
+	if _, err := c.Do(ctx, "Echo", []byte("hello")); CodeOf(err) != Unavailable {
+		t.Errorf("first call should fail with Unavailable, instead of %v", err)
+	}
+	rsp, err := c.Do(ctx, "Echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hello" {
+		t.Errorf("failed request should be served again, instead of %s", rsp)
+	}
+}
+
+// mapStore is a DedupStore without expiration
+type mapStore struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+func (s *mapStore) Get(key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	reply, ok := s.m[key]
+	return reply, ok
+}
+
+func (s *mapStore) Set(key string, reply []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.m == nil {
+		s.m = make(map[string][]byte)
+	}
+	s.m[key] = reply
+}
+
+// slowServer echoes the request after the open is closed
+type slowServer struct {
+	calls   int32
+	started chan struct{}
+	open    chan struct{}
+}
+
+func (s *slowServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.started <- struct{}{}
+	<-s.open
+	return req, nil
+}
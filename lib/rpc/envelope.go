@@ -11,8 +11,38 @@ var (
 	headerSeparator = []byte{10}
 )
 
+// Kind of the message, the zero value is the request or the reply
+type Kind uint8
+
+const (
+	// KindRequest is the request or the reply of a call
+	KindRequest Kind = iota
+
+	// KindCancel tells the server that the client doesn't wait for the
+	// reply of the correlation id any more
+	KindCancel
+
+	// KindStream is the request of a streamed reply and the frames of
+	// the streamed reply
+	KindStream
+
+	// KindEnd closes the streamed reply or the frames of the client, the
+	// end of the reply carries the error if any
+	KindEnd
+
+	// KindOpen is the request of a client stream or a bidirectional stream
+	KindOpen
+
+	// KindCredit lets the client send the frames of its stream up to the
+	// Seq to the ReplyTo topic of the credit
+	KindCredit
+)
+
 // Envelope arround message for request response communication over nsq
 type Envelope struct {
+	// kind of the message
+	Kind Kind `json:"y,omitempty"`
+
 	// name of the method to call on the server side
 	Method string `json:"m,omitempty"`
 
@@ -22,12 +52,49 @@ type Envelope struct {
 	// connection between request and response
 	CorrelationID uint32 `json:"c,omitempty"`
 
+	// sequence number of the stream frame, starts from 1, the end of the
+	// stream follows the last frame
+	Seq uint64 `json:"q,omitempty"`
+
+	// the same for every attempt of the call, so the server can
+	// recognize the retried requests
+	IdempotencyKey string `json:"i,omitempty"`
+
 	// unix timestamp when message expires, after that should be dropped
+	// second precision, only for the peers without SentAt and TTL
 	ExpiresAt int64 `json:"x,omitempty"`
 
+	// unix timestamp in milliseconds when the client sent the message
+	SentAt int64 `json:"s,omitempty"`
+
+	// time-to-live in milliseconds from SentAt, after that should be dropped
+	TTL int64 `json:"l,omitempty"`
+
+	// delay of the deferred publish in milliseconds, the TTL starts after
+	// it, so the delay doesn't count against the timeout of the call
+	Delay int64 `json:"d,omitempty"`
+
 	// applicationn error reponse, if server side failed and Body is missing
 	Error string `json:"e,omitempty"`
 
+	// status code of the application error
+	ErrorCode Code `json:"ec,omitempty"`
+
+	// structured details of the application error
+	ErrorDetails map[string]string `json:"ed,omitempty"`
+
+	// content type of the body, the reply uses the same as the request
+	ContentType string `json:"t,omitempty"`
+
+	// the body is compressed with snappy, Decode decompress it
+	Compressed bool `json:"z,omitempty"`
+
+	// metadata of the request or the reply
+	Header Header `json:"h,omitempty"`
+
+	// wire format of the header, the reply uses the same as the request
+	Format Format `json:"-"`
+
 	// message body
 	Body []byte `json:"-"`
 }
@@ -37,29 +104,144 @@ func (m *Envelope) Reply(body []byte, err error) *Envelope {
 	// refresh Envelope with the new body
 	e := &Envelope{
 		CorrelationID: m.CorrelationID,
+		ContentType:   m.ContentType,
+		Format:        m.Format,
 		Body:          body,
 	}
 
-	// attach err to the Envelope if it's not nil
-	if err != nil {
-		e.Error = err.Error()
+	// attach err to the Envelope if it's not nil, the message never empty
+	// because the older clients check only that
+	if s := StatusOf(err); s != nil {
+		e.Error = s.Message
+		if e.Error == "" {
+			e.Error = s.Code.String()
+		}
+		e.ErrorCode = s.Code
+		e.ErrorDetails = s.Details
 	}
 	return e
 }
 
+// Err returns the application error of the reply as *Status, nil if the
+// reply is successful, errors of the older servers get the Unknown code
+func (m *Envelope) Err() error {
+	if m.Error == "" && m.ErrorCode == OK {
+		return nil
+	}
+
+	code := m.ErrorCode
+	if code == OK {
+		code = Unknown
+	}
+	return &Status{
+		Code:    code,
+		Message: m.Error,
+		Details: m.ErrorDetails,
+	}
+}
+
 // Expired returns true if message expired
 func (m *Envelope) Expired() bool {
-	// checks ExpiresAt is nil of int
-	if m.ExpiresAt <= 0 {
+	// checks the message has deadline at all
+	d, ok := m.Deadline()
+	if !ok {
 		return false
 	}
 
 	// checks it is expired or not
-	return time.Now().Unix() > m.ExpiresAt
+	return !time.Now().Before(d)
 }
 
-// Decode decodes envelope from bytes
+// Deadline returns the time when the message expires, false if it never
+func (m *Envelope) Deadline() (time.Time, bool) {
+	return m.deadline(time.Now(), time.Time{}, 0)
+}
+
+// deadline calculates the local deadline of the message received at now
+// and published by nsqd at published, zero if it's unknown
+// the skew is the tolerated difference between the clocks of the peers
+// with SentAt and TTL the deadline is SentAt+Delay+TTL, the start in the
+// future of the local clock counts as now, so a late local clock never
+// extends the TTL, and an early one is tolerated up to the skew, then the
+// nsqd publish time plus the delay bounds the start, if it's known, so a
+// redelivered request of a client with fast clock doesn't get a fresh TTL
+// on every delivery, the publish time isn't used otherwise, because the
+// clock of nsqd can be off as well
+// without them the ExpiresAt has second precision, so the deadline is
+// the end of that second
+func (m *Envelope) deadline(now, published time.Time, skew time.Duration) (time.Time, bool) {
+	if m.SentAt > 0 && m.TTL > 0 {
+		sent := fromMillis(m.SentAt + m.Delay)
+		if sent.After(now) {
+			sent = now
+			if p := published.Add(time.Duration(m.Delay) * time.Millisecond); !published.IsZero() && p.Before(sent) {
+				sent = p
+			}
+		}
+		return sent.Add(time.Duration(m.TTL)*time.Millisecond + skew), true
+	}
+
+	if m.ExpiresAt > 0 {
+		return time.Unix(m.ExpiresAt+1, 0).Add(skew), true
+	}
+
+	return time.Time{}, false
+}
+
+// setDeadline fills the expiry fields from the deadline of the sender
+func (m *Envelope) setDeadline(now, d time.Time) {
+	m.ExpiresAt = d.Unix()
+	m.SentAt = toMillis(now)
+
+	// round up, so a short timeout never truncated to zero
+	m.TTL = int64((d.Sub(now) + time.Millisecond - 1) / time.Millisecond)
+	if m.TTL < 1 {
+		m.TTL = 1
+	}
+}
+
+// setDelay defers the deadline of the message by the delay, the
+// ExpiresAt is shifted by the delay rounded up to seconds for the peers
+// without SentAt and TTL
+func (m *Envelope) setDelay(delay time.Duration) {
+	// round up, like the TTL
+	m.Delay = int64((delay + time.Millisecond - 1) / time.Millisecond)
+	if m.ExpiresAt > 0 {
+		m.ExpiresAt += (m.Delay + 999) / 1000
+	}
+}
+
+// toMillis converts the time into unix timestamp in milliseconds
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis converts the unix timestamp in milliseconds into time
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Decode decodes envelope from bytes, the format detected by the first
+// byte, so the peers can use both of them during a rollout
+// the compressed body is decompressed
 func Decode(buf []byte) (*Envelope, error) {
+	e, err := decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.decompress(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// decode decodes the header of the detected format
+func decode(buf []byte) (*Envelope, error) {
+	if len(buf) > 0 && buf[0] == binaryVersion {
+		return decodeBinary(buf)
+	}
+
 	// get the body chunk
 	parts := bytes.SplitN(buf, headerSeparator, 2)
 
@@ -76,8 +258,12 @@ func Decode(buf []byte) (*Envelope, error) {
 	return e, nil
 }
 
-// Encode encodes envelope into bytes for putting on wire
+// Encode encodes envelope into bytes for putting on wire in its Format
 func (m *Envelope) Encode() []byte {
+	if m.Format == FormatBinary {
+		return m.encodeBinary()
+	}
+
 	// encode the Envelope to JSON without the body
 	buf, _ := json.Marshal(m)
 
@@ -71,6 +71,7 @@ func TestReply(t *testing.T) {
 		ReplyTo:       "rsc",
 		CorrelationID: 322232,
 		ExpiresAt:     int64(time.Now().Nanosecond()),
+		ContentType:   ContentTypeJSON,
 		Body:          []byte("request"),
 	}
 
@@ -79,4 +80,96 @@ func TestReply(t *testing.T) {
 	if string(resp.Body) != "response" {
 		t.Errorf("Body should be %s, instead of %s", string(resp.Body), "response")
 	}
+	if resp.ContentType != req.ContentType {
+		t.Errorf("ContentType should be %s, instead of %s", req.ContentType, resp.ContentType)
+	}
+}
+
+func TestDeadlineTTL(t *testing.T) {
+	now := time.Now()
+	e := Envelope{SentAt: toMillis(now.Add(-100 * time.Millisecond)), TTL: 200}
+
+	d, ok := e.deadline(now, time.Time{}, 0)
+	if want := fromMillis(e.SentAt).Add(200 * time.Millisecond); !ok || !d.Equal(want) {
+		t.Errorf("deadline should be %s, instead of %s", want, d)
+	}
+}
+
+func TestDeadlineSentInFuture(t *testing.T) {
+	// the local clock is an hour late compared to the sender
+	now := time.Now()
+	e := Envelope{SentAt: toMillis(now.Add(time.Hour)), TTL: 200}
+
+	d, ok := e.deadline(now, time.Time{}, 0)
+	if want := now.Add(200 * time.Millisecond); !ok || !d.Equal(want) {
+		t.Errorf("deadline should be %s, instead of %s", want, d)
+	}
+}
+
+func TestDeadlineRedelivered(t *testing.T) {
+	// the sender's clock is an hour fast, the request was published a
+	// second ago and it's redelivered now
+	now := time.Now()
+	e := Envelope{SentAt: toMillis(now.Add(time.Hour)), TTL: 200}
+
+	d, ok := e.deadline(now, now.Add(-time.Second), 0)
+	if !ok || now.Before(d) {
+		t.Errorf("redelivered request should be expired, instead of deadline %s", d)
+	}
+}
+
+func TestDeadlinePublishedLate(t *testing.T) {
+	// the clock of nsqd is an hour late, the sender's clock is right
+	now := time.Now()
+	e := Envelope{SentAt: toMillis(now.Add(-50 * time.Millisecond)), TTL: 200}
+
+	d, ok := e.deadline(now, now.Add(-time.Hour), 0)
+	if !ok || !now.Before(d) {
+		t.Errorf("request shouldn't be expired, instead of deadline %s", d)
+	}
+}
+
+func TestDeadlineSkew(t *testing.T) {
+	// the local clock is 50ms early, so the request looks expired
+	now := time.Now()
+	e := Envelope{SentAt: toMillis(now.Add(-250 * time.Millisecond)), TTL: 200}
+
+	if d, _ := e.deadline(now, time.Time{}, 0); now.Before(d) {
+		t.Error("request should be expired without skew allowance")
+	}
+	if d, _ := e.deadline(now, time.Time{}, 100*time.Millisecond); !now.Before(d) {
+		t.Error("request shouldn't be expired with skew allowance")
+	}
+}
+
+func TestDeadlineExpiresAt(t *testing.T) {
+	e := Envelope{ExpiresAt: 1000}
+
+	d, ok := e.deadline(time.Now(), time.Time{}, time.Second)
+	if want := time.Unix(1002, 0); !ok || !d.Equal(want) {
+		t.Errorf("deadline should be %s, instead of %s", want, d)
+	}
+
+	if _, ok := (&Envelope{}).Deadline(); ok {
+		t.Error("envelope without expiry shouldn't have deadline")
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	now := time.Now()
+
+	var e Envelope
+	d := now.Add(200*time.Millisecond + time.Microsecond)
+	e.setDeadline(now, d)
+	if e.TTL != 201 {
+		t.Errorf("TTL should be rounded up to 201, instead of %d", e.TTL)
+	}
+	if e.SentAt != toMillis(now) || e.ExpiresAt != d.Unix() {
+		t.Errorf("SentAt and ExpiresAt should be set, instead of %d %d", e.SentAt, e.ExpiresAt)
+	}
+
+	e.setDeadline(now, now.Add(-time.Second))
+	if e.TTL != 1 {
+		t.Errorf("TTL should be at least 1, instead of %d", e.TTL)
+	}
 }
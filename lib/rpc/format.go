@@ -0,0 +1,324 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Format is the wire format of the Envelope header
+type Format uint8
+
+const (
+	// FormatJSON encodes the header as JSON and separates it with a new line
+	// from the body, every peer understands it, this is the default
+	FormatJSON Format = iota
+
+	// FormatBinary encodes the header as length-prefixed fields behind a
+	// version byte, peers older than the format can't decode it
+	FormatBinary
+)
+
+// binaryVersion is the first byte of the binary format, it never
+// collides with the '{' of the JSON header
+const binaryVersion byte = 1
+
+// tags of the binary header fields
+const (
+	tagEnd byte = iota
+	tagMethod
+	tagReplyTo
+	tagCorrelationID
+	tagExpiresAt
+	tagError
+	tagContentType
+	tagCompressed
+	tagHeader
+	tagSentAt
+	tagTTL
+	tagErrorCode
+	tagErrorDetails
+	tagIdempotencyKey
+	tagKind
+	tagSeq
+	tagDelay
+)
+
+var errInvalidBinary = errors.New("invalid binary envelope")
+
+// encodeBinary encodes the envelope into the binary format
+// the header is a list of fields, a field is the tag byte, the length of
+// the value as uvarint and the value, the tagEnd closes the header and the
+// body follows it, numbers are stored as varints in the value
+func (m *Envelope) encodeBinary() []byte {
+	buf := make([]byte, 0, 32+len(m.Method)+len(m.ReplyTo)+len(m.IdempotencyKey)+len(m.Error)+len(m.ContentType)+len(m.Body))
+	buf = append(buf, binaryVersion)
+
+	if m.Kind != KindRequest {
+		buf = appendUvarint(buf, tagKind, uint64(m.Kind))
+	}
+	buf = appendString(buf, tagMethod, m.Method)
+	buf = appendString(buf, tagReplyTo, m.ReplyTo)
+	buf = appendString(buf, tagIdempotencyKey, m.IdempotencyKey)
+	if m.CorrelationID != 0 {
+		buf = appendUvarint(buf, tagCorrelationID, uint64(m.CorrelationID))
+	}
+	if m.Seq != 0 {
+		buf = appendUvarint(buf, tagSeq, m.Seq)
+	}
+	if m.ExpiresAt != 0 {
+		buf = appendVarint(buf, tagExpiresAt, m.ExpiresAt)
+	}
+	if m.SentAt != 0 {
+		buf = appendVarint(buf, tagSentAt, m.SentAt)
+	}
+	if m.TTL != 0 {
+		buf = appendVarint(buf, tagTTL, m.TTL)
+	}
+	if m.Delay != 0 {
+		buf = appendVarint(buf, tagDelay, m.Delay)
+	}
+	buf = appendString(buf, tagError, m.Error)
+	if m.ErrorCode != OK {
+		buf = appendUvarint(buf, tagErrorCode, uint64(m.ErrorCode))
+	}
+	if len(m.ErrorDetails) > 0 {
+		buf = appendHeader(buf, tagErrorDetails, m.ErrorDetails)
+	}
+	buf = appendString(buf, tagContentType, m.ContentType)
+	if m.Compressed {
+		buf = appendUvarint(buf, tagCompressed, 1)
+	}
+	if len(m.Header) > 0 {
+		buf = appendHeader(buf, tagHeader, m.Header)
+	}
+
+	// close the header, the rest is the body
+	buf = append(buf, tagEnd)
+	return append(buf, m.Body...)
+}
+
+// decodeBinary decodes the binary format, the first byte is the version
+// unknown fields are skipped, so newer peers can add fields
+func decodeBinary(buf []byte) (*Envelope, error) {
+	if len(buf) == 0 || buf[0] != binaryVersion {
+		return nil, errInvalidBinary
+	}
+	buf = buf[1:]
+
+	e := &Envelope{Format: FormatBinary}
+	for {
+		if len(buf) == 0 {
+			return nil, errInvalidBinary
+		}
+		tag := buf[0]
+		buf = buf[1:]
+
+		// end of the header, the rest is the body
+		if tag == tagEnd {
+			if len(buf) > 0 {
+				e.Body = buf
+			}
+			return e, nil
+		}
+
+		// length-prefixed value of the field
+		value, rest, err := lengthPrefixed(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = rest
+
+		if err := e.decodeField(tag, value); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeField sets the field of the tag from the value
+func (m *Envelope) decodeField(tag byte, value []byte) error {
+	switch tag {
+	case tagKind:
+		v, err := uvarint(value)
+		if err != nil {
+			return err
+		}
+		m.Kind = Kind(v)
+	case tagSeq:
+		v, err := uvarint(value)
+		if err != nil {
+			return err
+		}
+		m.Seq = v
+	case tagMethod:
+		m.Method = string(value)
+	case tagReplyTo:
+		m.ReplyTo = string(value)
+	case tagIdempotencyKey:
+		m.IdempotencyKey = string(value)
+	case tagCorrelationID:
+		v, err := uvarint(value)
+		if err != nil {
+			return err
+		}
+		m.CorrelationID = uint32(v)
+	case tagExpiresAt:
+		v, err := varint(value)
+		if err != nil {
+			return err
+		}
+		m.ExpiresAt = v
+	case tagSentAt:
+		v, err := varint(value)
+		if err != nil {
+			return err
+		}
+		m.SentAt = v
+	case tagTTL:
+		v, err := varint(value)
+		if err != nil {
+			return err
+		}
+		m.TTL = v
+	case tagDelay:
+		v, err := varint(value)
+		if err != nil {
+			return err
+		}
+		m.Delay = v
+	case tagError:
+		m.Error = string(value)
+	case tagErrorCode:
+		v, err := uvarint(value)
+		if err != nil {
+			return err
+		}
+		m.ErrorCode = Code(v)
+	case tagErrorDetails:
+		h, err := header(value)
+		if err != nil {
+			return err
+		}
+		m.ErrorDetails = h
+	case tagContentType:
+		m.ContentType = string(value)
+	case tagCompressed:
+		v, err := uvarint(value)
+		if err != nil {
+			return err
+		}
+		m.Compressed = v != 0
+	case tagHeader:
+		h, err := header(value)
+		if err != nil {
+			return err
+		}
+		m.Header = h
+	}
+	return nil
+}
+
+// appendString appends the string field, empty strings are omitted
+func appendString(buf []byte, tag byte, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	buf = append(buf, tag)
+	buf = appendLength(buf, len(s))
+	return append(buf, s...)
+}
+
+// appendHeader appends the header field, its value is the list of the
+// length-prefixed keys and values, ordered by the keys
+func appendHeader(buf []byte, tag byte, h Header) []byte {
+	keys := make([]string, 0, len(h))
+	n := 0
+	for k, v := range h {
+		keys = append(keys, k)
+		n += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	value := make([]byte, 0, n)
+	for _, k := range keys {
+		value = appendLength(value, len(k))
+		value = append(value, k...)
+		value = appendLength(value, len(h[k]))
+		value = append(value, h[k]...)
+	}
+
+	buf = append(buf, tag)
+	buf = appendLength(buf, len(value))
+	return append(buf, value...)
+}
+
+// appendUvarint appends the unsigned number field
+func appendUvarint(buf []byte, tag byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+
+	buf = append(buf, tag)
+	buf = appendLength(buf, n)
+	return append(buf, tmp[:n]...)
+}
+
+// appendVarint appends the signed number field
+func appendVarint(buf []byte, tag byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+
+	buf = append(buf, tag)
+	buf = appendLength(buf, n)
+	return append(buf, tmp[:n]...)
+}
+
+// appendLength appends the length prefix
+func appendLength(buf []byte, n int) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(n))]...)
+}
+
+// header decodes the value of the header field
+func header(value []byte) (Header, error) {
+	h := make(Header)
+	for len(value) > 0 {
+		k, rest, err := lengthPrefixed(value)
+		if err != nil {
+			return nil, err
+		}
+		v, rest, err := lengthPrefixed(rest)
+		if err != nil {
+			return nil, err
+		}
+		h[string(k)] = string(v)
+		value = rest
+	}
+	return h, nil
+}
+
+// lengthPrefixed splits the length-prefixed bytes from the rest
+func lengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || uint64(len(buf)-l) < n {
+		return nil, nil, errInvalidBinary
+	}
+	return buf[l : l+int(n)], buf[l+int(n):], nil
+}
+
+// uvarint decodes the value of an unsigned number field
+func uvarint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n != len(value) {
+		return 0, errInvalidBinary
+	}
+	return v, nil
+}
+
+// varint decodes the value of a signed number field
+func varint(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n != len(value) {
+		return 0, errInvalidBinary
+	}
+	return v, nil
+}
@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	e := &Envelope{
+		Method:        "Arith.Add",
+		ReplyTo:       "response",
+		CorrelationID: 322232,
+		ExpiresAt:     time.Now().Unix(),
+		SentAt:        toMillis(time.Now()),
+		TTL:           200,
+		Error:         "failed",
+		ContentType:   ContentTypeJSON,
+		Format:        FormatBinary,
+		Body:          []byte("{\"X\":1}\n{\"Y\":2}"),
+	}
+
+	buf := e.Encode()
+	if buf[0] != binaryVersion {
+		t.Errorf("first byte should be the version %d, instead of %d", binaryVersion, buf[0])
+	}
+
+	e2, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, e2) {
+		t.Errorf("decoded should be %+v, instead of %+v", e, e2)
+	}
+}
+
+func TestBinaryEmpty(t *testing.T) {
+	e := &Envelope{Format: FormatBinary}
+
+	e2, err := Decode(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, e2) {
+		t.Errorf("decoded should be %+v, instead of %+v", e, e2)
+	}
+}
+
+func TestBinaryUnknownField(t *testing.T) {
+	e := &Envelope{Method: "put", Format: FormatBinary, Body: []byte("msg")}
+	buf := e.Encode()
+
+	// insert an unknown field with 3 bytes value behind the version
+	unknown := []byte{200, 3, 'a', 'b', 'c'}
+	buf = append(buf[:1], append(unknown, buf[1:]...)...)
+
+	e2, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2.Method != "put" || string(e2.Body) != "msg" {
+		t.Errorf("decoded should be %+v, instead of %+v", e, e2)
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	e := &Envelope{Method: "put", CorrelationID: 322232, Format: FormatBinary}
+	buf := e.Encode()
+
+	// everything before the end tag is invalid
+	for i := 1; i < len(buf)-1; i++ {
+		if _, err := Decode(buf[:i]); err == nil {
+			t.Errorf("decoding %d bytes should fail", i)
+		}
+	}
+}
+
+func TestDecodeDetectsFormat(t *testing.T) {
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		e := &Envelope{Method: "put", CorrelationID: 322232, Format: f, Body: []byte("msg")}
+
+		e2, err := Decode(e.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e2.Format != f || e2.Method != "put" || !bytes.Equal(e2.Body, e.Body) {
+			t.Errorf("decoded should be %+v, instead of %+v", e, e2)
+		}
+	}
+}
+
+func TestCallBinary(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	c.SetFormat(FormatBinary)
+
+	// the reply should arrive in the format of the request
+	formats := make(chan Format, 1)
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", handlerFunc(func(rsp *Envelope) {
+		formats <- rsp.Format
+	}, c))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, _, err := c.Call(ctx, "Echo", []byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "msg" {
+		t.Errorf("response should be msg, instead of %s", rsp)
+	}
+	if f := <-formats; f != FormatBinary {
+		t.Errorf("reply format should be binary, instead of %d", f)
+	}
+}
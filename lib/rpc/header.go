@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Header is the string metadata of the request or the reply, e.g. auth
+// tokens, tenant ids, locale or request ids, carried beside the body
+type Header map[string]string
+
+// clone copies the header, nil stays nil
+func (h Header) clone() Header {
+	if h == nil {
+		return nil
+	}
+	c := make(Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+type (
+	// outgoingHeaderKey is the context key of the request header on the client side
+	outgoingHeaderKey struct{}
+
+	// incomingHeaderKey is the context key of the request header on the server side
+	incomingHeaderKey struct{}
+
+	// replyHeaderKey is the context key of the reply header on the server side
+	replyHeaderKey struct{}
+
+	// collectHeaderKey is the context key of the reply header on the client side
+	collectHeaderKey struct{}
+)
+
+// replyHeader collects the header of the reply, the server handler fills
+// it on the server side and the client fills it from the reply, the
+// two sides use different context keys, so a handler calling an other
+// service doesn't mix the replies
+type replyHeader struct {
+	sync.Mutex
+	h Header
+}
+
+// WithHeader attaches a header to the requests sent with the context
+// the previously attached headers are kept
+func WithHeader(ctx context.Context, key, value string) context.Context {
+	h, _ := ctx.Value(outgoingHeaderKey{}).(Header)
+	h = h.clone()
+	if h == nil {
+		h = make(Header)
+	}
+	h[key] = value
+
+	return context.WithValue(ctx, outgoingHeaderKey{}, h)
+}
+
+// WithReplyHeader returns a context which collects the header of the
+// reply into the non-nil h after the call
+func WithReplyHeader(ctx context.Context, h Header) context.Context {
+	return context.WithValue(ctx, collectHeaderKey{}, &replyHeader{h: h})
+}
+
+// HeaderFromContext returns the header of the request on the server side
+// the returned header shouldn't be modified
+func HeaderFromContext(ctx context.Context) Header {
+	h, _ := ctx.Value(incomingHeaderKey{}).(Header)
+	return h
+}
+
+// SetReplyHeader sets a header of the reply on the server side, it's a
+// no-op if the context doesn't belong to a request
+func SetReplyHeader(ctx context.Context, key, value string) {
+	rh, ok := ctx.Value(replyHeaderKey{}).(*replyHeader)
+	if !ok {
+		return
+	}
+
+	rh.Lock()
+	defer rh.Unlock()
+
+	if rh.h == nil {
+		rh.h = make(Header)
+	}
+	rh.h[key] = value
+}
+
+// outgoingHeader returns the header attached by WithHeader
+func outgoingHeader(ctx context.Context) Header {
+	h, _ := ctx.Value(outgoingHeaderKey{}).(Header)
+	return h
+}
+
+// withIncomingHeader attaches the request header and an empty reply header
+// to the context of the server handler
+func withIncomingHeader(ctx context.Context, h Header) (context.Context, *replyHeader) {
+	rh := &replyHeader{}
+	ctx = context.WithValue(ctx, incomingHeaderKey{}, h)
+	return context.WithValue(ctx, replyHeaderKey{}, rh), rh
+}
+
+// header returns the collected reply header
+func (rh *replyHeader) header() Header {
+	rh.Lock()
+	defer rh.Unlock()
+
+	return rh.h.clone()
+}
+
+// collectReplyHeader copies the header of the reply into the collector
+// attached by WithReplyHeader
+func collectReplyHeader(ctx context.Context, h Header) {
+	rh, ok := ctx.Value(collectHeaderKey{}).(*replyHeader)
+	if !ok || rh.h == nil {
+		return
+	}
+
+	rh.Lock()
+	defer rh.Unlock()
+
+	for k, v := range h {
+		rh.h[k] = v
+	}
+}
@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithHeader(t *testing.T) {
+	ctx1 := WithHeader(context.Background(), "tenant", "t1")
+	ctx2 := WithHeader(ctx1, "locale", "en")
+
+	if h := outgoingHeader(ctx1); len(h) != 1 || h["tenant"] != "t1" {
+		t.Errorf("first context should have only the tenant, instead of %v", h)
+	}
+	if h := outgoingHeader(ctx2); len(h) != 2 || h["tenant"] != "t1" || h["locale"] != "en" {
+		t.Errorf("second context should have both headers, instead of %v", h)
+	}
+	if h := HeaderFromContext(ctx2); h != nil {
+		t.Errorf("outgoing header shouldn't be incoming, instead of %v", h)
+	}
+}
+
+func TestSetReplyHeader(t *testing.T) {
+	// no-op outside of the request
+	SetReplyHeader(context.Background(), "k", "v")
+
+	ctx, rh := withIncomingHeader(context.Background(), Header{"tenant": "t1"})
+	SetReplyHeader(ctx, "k", "v")
+
+	if h := HeaderFromContext(ctx); h["tenant"] != "t1" {
+		t.Errorf("incoming header should be available, instead of %v", h)
+	}
+	if h := rh.header(); h["k"] != "v" {
+		t.Errorf("reply header should be set, instead of %v", h)
+	}
+}
+
+func TestCallHeader(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), headerServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rspHeader := Header{}
+	ctx = WithHeader(ctx, "tenant", "t1")
+	ctx = WithReplyHeader(ctx, rspHeader)
+
+	rsp, _, err := c.Call(ctx, "Tenant", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "t1" {
+		t.Errorf("server should see the tenant t1, instead of %s", rsp)
+	}
+	if rspHeader["served-by"] != "headerServer" {
+		t.Errorf("reply header should be collected, instead of %v", rspHeader)
+	}
+}
+
+func TestBinaryHeader(t *testing.T) {
+	e := &Envelope{
+		Method: "put",
+		Format: FormatBinary,
+		Header: Header{"tenant": "t1", "": "empty key", "locale": ""},
+	}
+
+	e2, err := Decode(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e2.Header) != 3 || e2.Header["tenant"] != "t1" || e2.Header[""] != "empty key" {
+		t.Errorf("header should be %v, instead of %v", e.Header, e2.Header)
+	}
+}
+
+// headerServer replies with the tenant header of the request
+type headerServer struct{}
+
+func (headerServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	SetReplyHeader(ctx, "served-by", "headerServer")
+	return []byte(HeaderFromContext(ctx)["tenant"]), nil
+}
@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// loopback is an in-memory Publisher, it delivers the published messages
+// straight to the handler subscribed on the topic, so no nsqd needed
+type loopback struct {
+	sync.Mutex
+	handlers map[string]nsq.Handler
+	msgNo    uint64
+
+	// multiPublished counts the MultiPublish calls
+	multiPublished int32
+}
+
+func newLoopback() *loopback {
+	return &loopback{handlers: make(map[string]nsq.Handler)}
+}
+
+func (l *loopback) subscribe(topic string, h nsq.Handler) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.handlers[topic] = h
+}
+
+func (l *loopback) Publish(topic string, body []byte) error {
+	l.Lock()
+	h, ok := l.handlers[topic]
+	l.Unlock()
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	go deliver(h, newMessage(atomic.AddUint64(&l.msgNo, 1), body))
+	return nil
+}
+
+func (l *loopback) MultiPublish(topic string, bodies [][]byte) error {
+	atomic.AddInt32(&l.multiPublished, 1)
+	for _, body := range bodies {
+		if err := l.Publish(topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *loopback) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	l.Lock()
+	_, ok := l.handlers[topic]
+	l.Unlock()
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	time.AfterFunc(delay, func() {
+		l.Publish(topic, body)
+	})
+	return nil
+}
+
+// deliver calls the handler like the go-nsq handler loop does
+func deliver(h nsq.Handler, m *nsq.Message) {
+	err := h.HandleMessage(m)
+	if m.IsAutoResponseDisabled() {
+		return
+	}
+	if err != nil {
+		m.Requeue(-1)
+		return
+	}
+	m.Finish()
+}
+
+func newMessage(no uint64, body []byte) *nsq.Message {
+	var id nsq.MessageID
+	copy(id[:], fmt.Sprintf("%016x", no))
+
+	m := nsq.NewMessage(id, body)
+	m.Attempts = 1
+	m.Delegate = &delegate{}
+	return m
+}
+
+// delegate records the responses given to the message
+type delegate struct {
+	finished int32
+	requeued int32
+	touched  int32
+	delay    time.Duration
+}
+
+func (d *delegate) OnFinish(*nsq.Message) {
+	atomic.AddInt32(&d.finished, 1)
+}
+
+func (d *delegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	atomic.AddInt32(&d.requeued, 1)
+	d.delay = delay
+}
+
+func (d *delegate) OnTouch(*nsq.Message) {
+	atomic.AddInt32(&d.touched, 1)
+}
+
+// handlerFunc peeks into the decoded envelopes before passing the
+// message to the next handler
+func handlerFunc(peek func(*Envelope), next nsq.Handler) nsq.Handler {
+	return nsq.HandlerFunc(func(m *nsq.Message) error {
+		if e, err := Decode(m.Body); err == nil {
+			peek(e)
+		}
+		return next.HandleMessage(m)
+	})
+}
+
+// rawHandlerFunc peeks into the raw message bodies before passing the
+// message to the next handler
+func rawHandlerFunc(peek func([]byte), next nsq.Handler) nsq.Handler {
+	return nsq.HandlerFunc(func(m *nsq.Message) error {
+		peek(m.Body)
+		return next.HandleMessage(m)
+	})
+}
@@ -0,0 +1,64 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// UnaryHandler serves the request on the server side, the end of the
+// server interceptor chain calls the AppServer
+type UnaryHandler func(ctx context.Context, req *Envelope) ([]byte, error)
+
+// ServerInterceptor wraps the serving of the requests, it sees the method,
+// the header and the body of the request, it calls next to continue the
+// chain or returns without calling it to reject the request
+type ServerInterceptor func(ctx context.Context, req *Envelope, next UnaryHandler) ([]byte, error)
+
+// Invoker sends the request on the client side and returns the reply, the
+// end of the client interceptor chain publishes the request
+type Invoker func(ctx context.Context, req *Envelope) (*Envelope, error)
+
+// ClientInterceptor wraps the calls, it can modify the outgoing request
+// before calling next and inspect the reply returned by next, the reply is
+// nil for the calls which don't wait for it, e.g. the notifications, the
+// asynchronous calls, the broadcasts and the streams
+type ClientInterceptor func(ctx context.Context, req *Envelope, next Invoker) (*Envelope, error)
+
+// send publishes the request through the interceptor chain without
+// waiting for the reply, the interceptors get nil reply, the notifications,
+// the asynchronous calls, the broadcasts and the streams use it
+func (c *Client) send(ctx context.Context, reqTopic string, delay time.Duration, eReq *Envelope) error {
+	_, err := c.intercept(ctx, eReq, func(ctx context.Context, eReq *Envelope) (*Envelope, error) {
+		// compress the large bodies, after the interceptors saw the original
+		eReq.Compress(c.compression)
+		if err := c.publishAfter(reqTopic, delay, eReq.Encode()); err != nil {
+			return nil, Errorf(Unavailable, "nsq publish failed: %s", err.Error())
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// chainServer composes the interceptors around the handler, the first
+// interceptor is the outermost
+func chainServer(interceptors []ServerInterceptor, h UnaryHandler) UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, req *Envelope) ([]byte, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return h
+}
+
+// chainClient composes the interceptors around the invoker, the first
+// interceptor is the outermost
+func chainClient(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, req *Envelope) (*Envelope, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,206 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	trace := func(name string) ServerInterceptor {
+		return func(ctx context.Context, req *Envelope, next UnaryHandler) ([]byte, error) {
+			order = append(order, name+">")
+			rsp, err := next(ctx, req)
+			order = append(order, "<"+name)
+			return rsp, err
+		}
+	}
+
+	h := chainServer([]ServerInterceptor{trace("a"), trace("b")}, func(ctx context.Context, req *Envelope) ([]byte, error) {
+		order = append(order, "serve")
+		return nil, nil
+	})
+	if _, err := h(context.Background(), &Envelope{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := strings.Join(order, " "); s != "a> b> serve <b <a" {
+		t.Errorf("the first interceptor should be the outermost, instead of %s", s)
+	}
+}
+
+func TestServerInterceptor(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	s := NewServer(context.Background(), echoServer{}, lb)
+	lb.subscribe("request", s)
+	lb.subscribe("response", c)
+
+	var mu sync.Mutex
+	var methods []string
+	s.Use(
+		// records every request
+		func(ctx context.Context, req *Envelope, next UnaryHandler) ([]byte, error) {
+			mu.Lock()
+			methods = append(methods, req.Method)
+			mu.Unlock()
+			return next(ctx, req)
+		},
+		// rejects the requests without the token
+		func(ctx context.Context, req *Envelope, next UnaryHandler) ([]byte, error) {
+			if req.Header["token"] != "secret" {
+				return nil, Errorf(Unauthenticated, "missing token")
+			}
+			return next(ctx, req)
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.Do(ctx, "Echo", []byte("hello"))
+	if CodeOf(err) != Unauthenticated {
+		t.Errorf("request without token should be Unauthenticated, instead of %v", err)
+	}
+
+	rsp, err := c.Do(WithHeader(ctx, "token", "secret"), "Echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hello" {
+		t.Errorf("response should be hello, instead of %s", rsp)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) != 2 || methods[0] != "Echo" {
+		t.Errorf("both requests should be recorded, instead of %v", methods)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	c.SetCompression(1)
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	var reply string
+	c.Use(func(ctx context.Context, req *Envelope, next Invoker) (*Envelope, error) {
+		// the interceptor sees the body before the compression
+		req.Body = append(req.Body, " world"...)
+		rsp, err := next(ctx, req)
+		if err == nil {
+			reply = string(rsp.Body)
+		}
+		return rsp, err
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, err := c.Do(ctx, "Echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hello world" {
+		t.Errorf("modified request should be sent, instead of %s", rsp)
+	}
+	if reply != "hello world" {
+		t.Errorf("interceptor should see the reply, instead of %s", reply)
+	}
+}
+
+func TestClientInterceptorAsync(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	echo := NewServer(context.Background(), echoServer{}, lb)
+	count := NewServer(context.Background(), countServer{}, lb)
+	lb.subscribe("request", echo)
+	lb.subscribe("count", count)
+	lb.subscribe("response", c)
+
+	// the server rejects the requests without the token, the client
+	// interceptor attaches it to every call
+	for _, s := range []*Server{echo, count} {
+		s.Use(func(ctx context.Context, req *Envelope, next UnaryHandler) ([]byte, error) {
+			if req.Header["token"] != "secret" {
+				return nil, Errorf(Unauthenticated, "missing token")
+			}
+			return next(ctx, req)
+		})
+	}
+	c.Use(func(ctx context.Context, req *Envelope, next Invoker) (*Envelope, error) {
+		if req.Header == nil {
+			req.Header = make(Header)
+		}
+		req.Header["token"] = "secret"
+		return next(ctx, req)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if call := <-c.Go(ctx, "Echo", nil, nil).Done; call.Error != nil {
+		t.Errorf("asynchronous call should have the token, instead of %v", call.Error)
+	}
+
+	calls := []*Call{{Method: "Echo"}, {Method: "Echo"}}
+	c.Batch(ctx, calls)
+	for _, call := range calls {
+		if call.Error != nil {
+			t.Errorf("batched call should have the token, instead of %v", call.Error)
+		}
+	}
+
+	replies, err := c.Broadcast(ctx, "Echo", nil, BroadcastOptions{Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replies[0].Err(); err != nil {
+		t.Errorf("broadcast should have the token, instead of %v", err)
+	}
+
+	s, err := c.StreamTopic(ctx, "count", "Count", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Errorf("stream should have the token, instead of %v", err)
+	}
+}
+
+func TestClientInterceptorReject(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	c.Use(func(ctx context.Context, req *Envelope, next Invoker) (*Envelope, error) {
+		return nil, Errorf(PermissionDenied, "%s denied", req.Method)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if call := <-c.Go(ctx, "Echo", nil, nil).Done; CodeOf(call.Error) != PermissionDenied {
+		t.Errorf("rejected call should be PermissionDenied, instead of %v", call.Error)
+	}
+	calls := []*Call{{Method: "Echo"}}
+	c.Batch(ctx, calls)
+	if CodeOf(calls[0].Error) != PermissionDenied {
+		t.Errorf("rejected batched call should be PermissionDenied, instead of %v", calls[0].Error)
+	}
+	if _, err := c.OpenStream(ctx, "Sum"); CodeOf(err) != PermissionDenied {
+		t.Errorf("rejected stream should be PermissionDenied, instead of %v", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.calls) != 0 || len(c.streams) != 0 {
+		t.Errorf("calls and streams should be empty, instead of %d, %d", len(c.calls), len(c.streams))
+	}
+}
@@ -0,0 +1,48 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Notify sends a one-way message to the method, no reply is expected
+// and no reply topic is attached, it returns after the message published
+func (c *Client) Notify(ctx context.Context, typ string, body []byte) error {
+	return c.NotifyTopic(ctx, c.reqTopic, typ, body)
+}
+
+// NotifyTopic is the same as the Notify, but it gets the topic to send
+// the message, the client interceptors get nil reply for it
+func (c *Client) NotifyTopic(ctx context.Context, reqTopic, typ string, body []byte) error {
+	return c.notify(ctx, reqTopic, typ, body, 0)
+}
+
+// notify publishes the notification deferred by the delay
+func (c *Client) notify(ctx context.Context, reqTopic, typ string, body []byte, delay time.Duration) error {
+	eReq := c.request(ctx, typ, body)
+	eReq.ReplyTo = ""
+	if delay > 0 {
+		eReq.setDelay(delay)
+	}
+
+	return c.send(ctx, reqTopic, delay, eReq)
+}
+
+// SetReplyRequired sets the methods which can't be notified, the
+// notifications of them are dropped without calling the AppServer
+func (s *Server) SetReplyRequired(methods ...string) {
+	s.replyRequired = make(map[string]bool, len(methods))
+	for _, method := range methods {
+		s.replyRequired[method] = true
+	}
+}
+
+// rejected returns an error if the request is a notification of a method
+// which requires reply
+func (s *Server) rejected(req *Envelope) error {
+	if req.ReplyTo != "" || req.Kind != KindRequest || !s.replyRequired[req.Method] {
+		return nil
+	}
+	return fmt.Errorf("notification of %s rejected, it requires reply", req.Method)
+}
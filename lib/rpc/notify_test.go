@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &notifiedServer{received: make(chan *RequestInfo, 1)}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+
+	var intercepted bool
+	c.Use(func(ctx context.Context, req *Envelope, next Invoker) (*Envelope, error) {
+		intercepted = true
+		return next(ctx, req)
+	})
+
+	if err := c.Notify(context.Background(), "Expire", []byte("session-1")); err != nil {
+		t.Fatal(err)
+	}
+	if !intercepted {
+		t.Error("notification should go through the interceptors")
+	}
+
+	select {
+	case info := <-srv.received:
+		if info.Method != "Expire" || info.ReplyTo != "" {
+			t.Errorf("server should get Expire without reply topic, instead of %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server should get the notification")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.subscribers) != 0 {
+		t.Errorf("notification shouldn't subscribe, instead of %d subscribers", len(c.subscribers))
+	}
+}
+
+func TestNotifyUnavailable(t *testing.T) {
+	c := NewClient(newLoopback(), "request", "response")
+
+	if err := c.Notify(context.Background(), "Expire", nil); CodeOf(err) != Unavailable {
+		t.Errorf("notification without topic should be Unavailable, instead of %v", err)
+	}
+}
+
+func TestReplyRequired(t *testing.T) {
+	srv := &notifiedServer{received: make(chan *RequestInfo, 1)}
+	s := NewServer(context.Background(), srv, newLoopback())
+	s.SetReplyRequired("Get")
+
+	m := newMessage(1, (&Envelope{Method: "Get"}).Encode())
+	if err := s.HandleMessage(m); err == nil {
+		t.Error("notification of Get should be rejected")
+	}
+	if d := m.Delegate.(*delegate); atomic.LoadInt32(&d.finished) != 1 {
+		t.Error("rejected notification should be finished")
+	}
+
+	if err := s.HandleMessage(newMessage(2, (&Envelope{Method: "Expire"}).Encode())); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Errorf("server should be called only for Expire, instead of %d times", calls)
+	}
+}
+
+// notifiedServer records the notifications
+type notifiedServer struct {
+	calls    int32
+	received chan *RequestInfo
+}
+
+func (n *notifiedServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	atomic.AddInt32(&n.calls, 1)
+	info, _ := RequestFromContext(ctx)
+	select {
+	case n.received <- info:
+	default:
+	}
+	return nil, nil
+}
@@ -0,0 +1,22 @@
+package rpc
+
+import "time"
+
+// Publisher sends raw messages to nsq topics, *nsq.Producer implements it
+// it's an interface so the client and the server can share a producer and
+// so they can be driven without a running nsqd
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
+// MultiPublisher sends many messages to a topic at once, *nsq.Producer
+// implements it, the batches use it if the Publisher implements it too
+type MultiPublisher interface {
+	MultiPublish(topic string, body [][]byte) error
+}
+
+// DeferredPublisher sends a message which is delivered after the delay by
+// nsqd, *nsq.Producer implements it, the scheduled calls require it
+type DeferredPublisher interface {
+	DeferredPublish(topic string, delay time.Duration, body []byte) error
+}
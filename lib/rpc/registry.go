@@ -0,0 +1,196 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	// reflect types of the method signature parts
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Registry is an AppServer which routes the requests to the methods of
+// the registered receivers in the style of net/rpc, the method of the
+// request is "Service.Method", for example "Arith.Add", the bodies are
+// decoded by the codec of the content type declared in the request and
+// encoded by the same for the reply, JSON if the request didn't declare
+// the suitable methods have the following signature:
+//
+//	func (t *T) Name(ctx context.Context, req *Req) (*Resp, error)
+type Registry struct {
+	// services stores the registered receivers by name
+	services map[string]*service
+
+	// codec encodes and decodes the bodies without content type
+	codec Codec
+
+	// add mutex to handle critical points
+	sync.RWMutex
+}
+
+// service is a registered receiver with its suitable methods
+type service struct {
+	rcvr    reflect.Value
+	methods map[string]*method
+}
+
+// method stores the reflection data of a suitable method
+type method struct {
+	fn      reflect.Value
+	reqType reflect.Type
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]*service),
+		codec:    JSONCodec{},
+	}
+}
+
+// SetCodec replaces the default JSON codec of the bodies without declared
+// content type, it should be called before serving any request
+func (r *Registry) SetCodec(c Codec) {
+	r.codec = c
+}
+
+// Register publishes the suitable methods of the receiver under the
+// name of its concrete type
+func (r *Registry) Register(rcvr interface{}) error {
+	return r.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName is the same as Register, but uses the given name for
+// the service instead of the name of the type
+func (r *Registry) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("no service name for type " + reflect.TypeOf(rcvr).String())
+	}
+	if strings.Contains(name, ".") {
+		return errors.New("service name can't contain dot: " + name)
+	}
+
+	// collect the suitable methods of the receiver
+	s := &service{
+		rcvr:    reflect.ValueOf(rcvr),
+		methods: make(map[string]*method),
+	}
+	typ := s.rcvr.Type()
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		if reqType, ok := suitable(m); ok {
+			s.methods[m.Name] = &method{
+				fn:      s.rcvr.Method(i),
+				reqType: reqType,
+			}
+		}
+	}
+	if len(s.methods) == 0 {
+		return errors.New("no suitable methods on service " + name)
+	}
+
+	// lock the critical section to avoid race condition
+	r.Lock()
+	defer r.Unlock()
+
+	if _, found := r.services[name]; found {
+		return errors.New("service already registered: " + name)
+	}
+	r.services[name] = s
+
+	return nil
+}
+
+// Serve decodes the request of the method, calls it and encodes its response
+func (r *Registry) Serve(ctx context.Context, typ string, req []byte) ([]byte, error) {
+	m, err := r.lookup(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := r.codecFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the request into a new value of the argument type
+	// empty body leaves the argument as zero value
+	arg := reflect.New(m.reqType.Elem())
+	if len(req) > 0 {
+		if err := codec.Unmarshal(req, arg.Interface()); err != nil {
+			return nil, Errorf(InvalidArgument, "invalid request of %s: %s", typ, err.Error())
+		}
+	}
+
+	// call the method, the error of the method goes back as it is
+	out := m.fn.Call([]reflect.Value{reflect.ValueOf(ctx), arg})
+	if errOut := out[1].Interface(); errOut != nil {
+		return nil, errOut.(error)
+	}
+
+	return codec.Marshal(out[0].Interface())
+}
+
+// codecFor returns the codec of the request's content type
+func (r *Registry) codecFor(ctx context.Context) (Codec, error) {
+	ct := ContentTypeFromContext(ctx)
+	if ct == "" || ct == r.codec.ContentType() {
+		return r.codec, nil
+	}
+
+	c, ok := GetCodec(ct)
+	if !ok {
+		return nil, Errorf(Unimplemented, "unsupported content type: %s", ct)
+	}
+	return c, nil
+}
+
+// lookup finds the method based on the "Service.Method" name
+func (r *Registry) lookup(typ string) (*method, error) {
+	dot := strings.LastIndex(typ, ".")
+	if dot < 0 {
+		return nil, Errorf(Unimplemented, "method not found: %s", typ)
+	}
+
+	// lock the critical section to avoid race condition
+	r.RLock()
+	s, found := r.services[typ[:dot]]
+	r.RUnlock()
+	if !found {
+		return nil, Errorf(Unimplemented, "method not found: %s", typ)
+	}
+
+	m, found := s.methods[typ[dot+1:]]
+	if !found {
+		return nil, Errorf(Unimplemented, "method not found: %s", typ)
+	}
+
+	return m, nil
+}
+
+// suitable checks the signature of the method and returns the type of
+// its request argument
+func suitable(m reflect.Method) (reflect.Type, bool) {
+	// unexported methods are not published
+	if m.PkgPath != "" {
+		return nil, false
+	}
+
+	// receiver, context, request pointer
+	mt := m.Type
+	if mt.NumIn() != 3 || mt.In(1) != typeOfContext || mt.In(2).Kind() != reflect.Ptr {
+		return nil, false
+	}
+
+	// response pointer, error
+	if mt.NumOut() != 2 || mt.Out(0).Kind() != reflect.Ptr || mt.Out(1) != typeOfError {
+		return nil, false
+	}
+
+	return mt.In(2), true
+}
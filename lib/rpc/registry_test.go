@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.services["Arith"]
+	if s == nil {
+		t.Fatal("Arith should be registered")
+	}
+	if len(s.methods) != 2 {
+		t.Errorf("Arith should have 2 methods, instead of %d", len(s.methods))
+	}
+	if err := r.Register(&Arith{}); err == nil {
+		t.Error("second registration should fail")
+	}
+}
+
+func TestRegisterNoMethods(t *testing.T) {
+	if err := NewRegistry().Register(&struct{}{}); err == nil {
+		t.Error("registration without suitable methods should fail")
+	}
+	if err := NewRegistry().RegisterName("Ari.th", &Arith{}); err == nil {
+		t.Error("registration with dot in the name should fail")
+	}
+}
+
+func TestRegistryServe(t *testing.T) {
+	r := NewRegistry()
+	if err := r.RegisterName("Calc", &Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rspBuf, err := r.Serve(context.Background(), "Calc.Add", []byte(`{"X":3,"Y":4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rsp ArithResponse
+	if err := json.Unmarshal(rspBuf, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Z != 7 {
+		t.Errorf("Z should be 7, instead of %d", rsp.Z)
+	}
+}
+
+func TestRegistryServeError(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := r.Serve(context.Background(), "Arith.Div", []byte(`{"X":3}`))
+	if err != errDivByZero {
+		t.Errorf("error should be %v, instead of %v", errDivByZero, err)
+	}
+
+	_, err = r.Serve(context.Background(), "Arith.Add", []byte(`{"X":`))
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid request") {
+		t.Errorf("error should be invalid request, instead of %v", err)
+	}
+}
+
+func TestRegistryMethodNotFound(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []string{"Add", "Arith.Sub", "Math.Add", "Arith.unexported"} {
+		_, err := r.Serve(context.Background(), typ, nil)
+		if err == nil || err.Error() != "method not found: "+typ {
+			t.Errorf("%s should be not found, instead of %v", typ, err)
+		}
+	}
+}
+
+type ArithRequest struct {
+	X int
+	Y int
+}
+
+type ArithResponse struct {
+	Z int
+}
+
+var errDivByZero = errors.New("divide by zero")
+
+// Arith is the registered test service
+type Arith struct{}
+
+func (Arith) Add(ctx context.Context, req *ArithRequest) (*ArithResponse, error) {
+	return &ArithResponse{Z: req.X + req.Y}, nil
+}
+
+func (Arith) Div(ctx context.Context, req *ArithRequest) (*ArithResponse, error) {
+	if req.Y == 0 {
+		return nil, errDivByZero
+	}
+	return &ArithResponse{Z: req.X / req.Y}, nil
+}
+
+// not suitable signatures, these are not published
+func (Arith) Mul(req *ArithRequest) (*ArithResponse, error) { return nil, nil }
+func (Arith) Sub(ctx context.Context, req ArithRequest) (*ArithResponse, error) {
+	return nil, nil
+}
+func (Arith) unexported(ctx context.Context, req *ArithRequest) (*ArithResponse, error) {
+	return nil, nil
+}
+
+func TestRegistryContentType(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqBuf, _ := MsgpackCodec{}.Marshal(&ArithRequest{X: 3, Y: 4})
+	ctx := WithContentType(context.Background(), ContentTypeMsgpack)
+	rspBuf, err := r.Serve(ctx, "Arith.Add", reqBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rsp ArithResponse
+	if err := (MsgpackCodec{}).Unmarshal(rspBuf, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Z != 7 {
+		t.Errorf("Z should be 7, instead of %d", rsp.Z)
+	}
+
+	ctx = WithContentType(context.Background(), "application/xml")
+	_, err = r.Serve(ctx, "Arith.Add", reqBuf)
+	if err == nil || err.Error() != "unsupported content type: application/xml" {
+		t.Errorf("error should be unsupported content type, instead of %v", err)
+	}
+}
+
+func TestInvokeRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), r, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var rsp ArithResponse
+	if err := Invoke(ctx, c, MsgpackCodec{}, "Arith.Add", &ArithRequest{X: 3, Y: 4}, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Z != 7 {
+		t.Errorf("Z should be 7, instead of %d", rsp.Z)
+	}
+
+	err := Invoke(ctx, c, MsgpackCodec{}, "Arith.Div", &ArithRequest{X: 3}, &rsp)
+	if err == nil || err.Error() != errDivByZero.Error() {
+		t.Errorf("error should be %v, instead of %v", errDivByZero, err)
+	}
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// RequestInfo is the metadata of the request served by the AppServer
+type RequestInfo struct {
+	// Method is the name of the called method
+	Method string
+
+	// CorrelationID connects the request and the reply
+	CorrelationID uint32
+
+	// ReplyTo is the topic of the reply, empty if no reply expected
+	ReplyTo string
+
+	// IdempotencyKey is the same for every attempt of the call
+	IdempotencyKey string
+
+	// Attempts is the number of the nsq delivery attempts
+	Attempts uint16
+
+	// Timestamp is the time when the message was published to nsqd
+	Timestamp time.Time
+}
+
+// requestInfoKey is the context key of the RequestInfo
+type requestInfoKey struct{}
+
+// RequestFromContext returns the metadata of the request on the server side
+func RequestFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// requestContext derives the context of the request from the server
+// context, it's cancelled at the deadline of the request, when the client
+// no longer waits for the reply, and carries the RequestInfo
+// zero deadline means the request never expires
+func requestContext(ctx context.Context, m *nsq.Message, req *Envelope, deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, requestInfoKey{}, &RequestInfo{
+		Method:         req.Method,
+		CorrelationID:  req.CorrelationID,
+		ReplyTo:        req.ReplyTo,
+		IdempotencyKey: req.IdempotencyKey,
+		Attempts:       m.Attempts,
+		Timestamp:      time.Unix(0, m.Timestamp),
+	})
+
+	if !deadline.IsZero() {
+		return context.WithDeadline(ctx, deadline)
+	}
+	return context.WithCancel(ctx)
+}
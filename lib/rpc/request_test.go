@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestRequestContext(t *testing.T) {
+	m := newMessage(1, nil)
+	m.Attempts = 3
+	req := &Envelope{
+		Method:        "Arith.Add",
+		ReplyTo:       "response",
+		CorrelationID: 322232,
+		ExpiresAt:     time.Now().Add(time.Minute).Unix(),
+	}
+
+	want, _ := req.Deadline()
+	ctx, cancel := requestContext(context.Background(), m, req, want)
+	defer cancel()
+
+	info, ok := RequestFromContext(ctx)
+	if !ok {
+		t.Fatal("request info should be in the context")
+	}
+	if info.Method != "Arith.Add" || info.CorrelationID != 322232 || info.ReplyTo != "response" || info.Attempts != 3 {
+		t.Errorf("request info should describe the request, instead of %+v", info)
+	}
+	if info.Timestamp.UnixNano() != m.Timestamp {
+		t.Errorf("timestamp should be %d, instead of %d", m.Timestamp, info.Timestamp.UnixNano())
+	}
+
+	d, ok := ctx.Deadline()
+	if !ok || !d.Equal(want) {
+		t.Errorf("deadline should be %s, instead of %s", want, d)
+	}
+}
+
+func TestRequestContextWithoutExpiry(t *testing.T) {
+	ctx, cancel := requestContext(context.Background(), newMessage(1, nil), &Envelope{}, time.Time{})
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("request without expiry shouldn't have deadline")
+	}
+
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("context should be cancelled, instead of %v", ctx.Err())
+	}
+}
+
+func TestHandleMessageExpiresWhileServing(t *testing.T) {
+	lb := newLoopback()
+	replies := make(chan struct{}, 1)
+	lb.subscribe("response", nsq.HandlerFunc(func(m *nsq.Message) error {
+		replies <- struct{}{}
+		return nil
+	}))
+
+	// the request expires at the end of the current second
+	req := &Envelope{Method: "Wait", ReplyTo: "response", ExpiresAt: time.Now().Unix()}
+	m := newMessage(1, req.Encode())
+	srv := NewServer(context.Background(), deadlineServer{}, lb)
+
+	if err := srv.HandleMessage(m); err == nil {
+		t.Error("expired request should return error")
+	}
+	if d := m.Delegate.(*delegate); d.finished != 1 {
+		t.Errorf("expired message should be finished, instead of %d", d.finished)
+	}
+
+	select {
+	case <-replies:
+		t.Error("expired request shouldn't be replied")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandleMessageRedelivered(t *testing.T) {
+	srv := &notifiedServer{}
+	s := NewServer(context.Background(), srv, newLoopback())
+
+	// the sender's clock is an hour fast, nsqd published the request a
+	// second ago, its TTL is over even if its SentAt is in the future
+	now := time.Now()
+	req := &Envelope{Method: "Expire", SentAt: toMillis(now.Add(time.Hour)), TTL: 200}
+	m := newMessage(1, req.Encode())
+	m.Timestamp = now.Add(-time.Second).UnixNano()
+	m.Attempts = 2
+
+	if err := s.HandleMessage(m); err == nil {
+		t.Error("redelivered request should be expired")
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 0 {
+		t.Errorf("expired request shouldn't be served, instead of %d times", calls)
+	}
+}
+
+func TestHandleMessagePublishedLate(t *testing.T) {
+	srv := &notifiedServer{}
+	s := NewServer(context.Background(), srv, newLoopback())
+
+	// the clock of nsqd is an hour late, the SentAt of the sender is valid
+	now := time.Now()
+	req := &Envelope{Method: "Serve", SentAt: toMillis(now), TTL: 1000}
+	m := newMessage(1, req.Encode())
+	m.Timestamp = now.Add(-time.Hour).UnixNano()
+
+	if err := s.HandleMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Errorf("request should be served once, instead of %d times", calls)
+	}
+}
+
+// deadlineServer works until the request context is done
+type deadlineServer struct{}
+
+func (deadlineServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
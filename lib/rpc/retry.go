@@ -0,0 +1,188 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultInitialBackoff is the wait before the first retry
+	defaultInitialBackoff = 100 * time.Millisecond
+
+	// defaultMultiplier grows the backoff between the retries
+	defaultMultiplier = 2
+
+	// idempotencyKeyLength is the length of the hex idempotency keys
+	idempotencyKeyLength = 32
+)
+
+// defaultRetryableCodes used if the RetryableCodes of the policy is empty
+var defaultRetryableCodes = []Code{Unavailable, DeadlineExceeded}
+
+// RetryPolicy determines how the client retries the failed calls
+// every attempt carries the same idempotency key, so the server can
+// recognize the retried requests, but every attempt gets a new
+// correlation id, so a late reply of the previous attempt is dropped
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one,
+	// one or less turns off the retries
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, 100ms by default
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between the attempts, zero means no cap
+	MaxBackoff time.Duration
+
+	// Multiplier grows the backoff after every attempt, 2 by default
+	Multiplier float64
+
+	// Jitter randomizes the backoff by the given fraction of it, between
+	// 0 and 1, so the clients don't retry at the same time
+	Jitter float64
+
+	// RetryableCodes are the status codes worth retrying, by default
+	// Unavailable and DeadlineExceeded
+	RetryableCodes []Code
+
+	// PerAttemptTimeout limits every attempt, so a lost request can be
+	// retried within the deadline of the call, zero means no limit
+	PerAttemptTimeout time.Duration
+}
+
+// retryable returns true if the code worth retrying
+func (p RetryPolicy) retryable(code Code) bool {
+	codes := p.RetryableCodes
+	if len(codes) == 0 {
+		codes = defaultRetryableCodes
+	}
+
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the retry of the attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	if d <= 0 {
+		d = float64(defaultInitialBackoff)
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+
+	// grow the backoff exponentially, but never above the cap
+	for i := 1; i < attempt; i++ {
+		d *= multiplier
+		if p.MaxBackoff > 0 && d >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+
+	// spread the retries randomly in the [d-jitter*d, d+jitter*d] range
+	if jitter := p.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d += d * jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// idempotencyKeyKey is the context key of the idempotency key
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey sets the idempotency key of the call, without it the
+// client generates a random one for the calls with retry policy
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// idempotencyKey returns the idempotency key of the context
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
+}
+
+// SetRetryPolicy sets the retry policy of the method, the policy of the
+// empty method is the default for all the others, it should be called
+// before the first call
+func (c *Client) SetRetryPolicy(method string, p RetryPolicy) {
+	if c.retryPolicies == nil {
+		c.retryPolicies = make(map[string]RetryPolicy)
+	}
+	c.retryPolicies[method] = p
+}
+
+// retryPolicy returns the retry policy of the method
+func (c *Client) retryPolicy(method string) (RetryPolicy, bool) {
+	if p, ok := c.retryPolicies[method]; ok {
+		return p, true
+	}
+	p, ok := c.retryPolicies[""]
+	return p, ok
+}
+
+// retry sends the request until it succeeds, fails with a not retryable
+// code or the policy of the method gives up
+func (c *Client) retry(ctx context.Context, reqTopic string, eReq *Envelope) (*Envelope, error) {
+	p, ok := c.retryPolicy(eReq.Method)
+	if !ok || (p.MaxAttempts <= 1 && p.PerAttemptTimeout <= 0) {
+		return c.roundTrip(ctx, reqTopic, eReq)
+	}
+
+	// the same key for every attempt, so the server can deduplicate them
+	if eReq.IdempotencyKey == "" {
+		eReq.IdempotencyKey = randomHex(idempotencyKeyLength / 2)
+	}
+
+	for attempt := 1; ; attempt++ {
+		rsp, err := c.attempt(ctx, reqTopic, eReq, p.PerAttemptTimeout)
+
+		// the failure of the attempt, either the transport or the reply
+		code := CodeOf(err)
+		if err == nil {
+			code = CodeOf(rsp.Err())
+		}
+
+		// give up if succeeded, the call is over or the error is final
+		if code == OK || attempt >= p.MaxAttempts || ctx.Err() != nil || !p.retryable(code) {
+			return rsp, err
+		}
+
+		// wait before the next attempt, unless the call is over
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt sends the request once, limited by the timeout if it's positive
+func (c *Client) attempt(ctx context.Context, reqTopic string, eReq *Envelope, timeout time.Duration) (*Envelope, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// the server drops the attempt at its own deadline
+	if d, ok := ctx.Deadline(); ok {
+		eReq.setDeadline(time.Now(), d)
+	}
+
+	return c.roundTrip(ctx, reqTopic, eReq)
+}
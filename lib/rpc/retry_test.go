@@ -0,0 +1,180 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		if d := p.backoff(i + 1); d != e*time.Millisecond {
+			t.Errorf("backoff of attempt %d should be %v, instead of %v", i+1, e*time.Millisecond, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(1); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("jittered backoff should be between 5ms and 15ms, instead of %v", d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{failures: 2, code: Unavailable}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	c.SetRetryPolicy("", RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, err := c.Do(ctx, "Echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hello" {
+		t.Errorf("response should be hello, instead of %s", rsp)
+	}
+
+	keys := srv.keys()
+	if len(keys) != 3 {
+		t.Fatalf("server should get 3 attempts, instead of %d", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("every attempt should have the same idempotency key, instead of %v", keys)
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{failures: 5, code: Unavailable}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	c.SetRetryPolicy("Echo", RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.Do(WithIdempotencyKey(ctx, "key-1"), "Echo", nil)
+	if CodeOf(err) != Unavailable {
+		t.Errorf("error should be Unavailable, instead of %v", err)
+	}
+	if keys := srv.keys(); len(keys) != 2 || keys[0] != "key-1" {
+		t.Errorf("server should get 2 attempts with key-1, instead of %v", keys)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{failures: 1, code: InvalidArgument}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	c.SetRetryPolicy("", RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.Do(ctx, "Echo", nil)
+	if CodeOf(err) != InvalidArgument {
+		t.Errorf("error should be InvalidArgument, instead of %v", err)
+	}
+	if keys := srv.keys(); len(keys) != 1 {
+		t.Errorf("server should get only 1 attempt, instead of %d", len(keys))
+	}
+}
+
+func TestRetryPerAttemptTimeout(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &flakyServer{failures: 1}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	c.SetRetryPolicy("", RetryPolicy{
+		MaxAttempts:       2,
+		InitialBackoff:    time.Millisecond,
+		PerAttemptTimeout: 50 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, err := c.Do(ctx, "Echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hello" {
+		t.Errorf("second attempt should reply hello, instead of %s", rsp)
+	}
+}
+
+func TestBinaryIdempotencyKey(t *testing.T) {
+	e := &Envelope{Method: "put", IdempotencyKey: "key-1", Format: FormatBinary}
+
+	e2, err := Decode(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2.IdempotencyKey != "key-1" {
+		t.Errorf("idempotency key should be key-1, instead of %s", e2.IdempotencyKey)
+	}
+}
+
+// flakyServer fails the first requests with the code, without code it
+// doesn't reply to them until their deadline, then echoes the body
+type flakyServer struct {
+	sync.Mutex
+	failures int
+	code     Code
+	received []string
+}
+
+func (f *flakyServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	info, _ := RequestFromContext(ctx)
+
+	f.Lock()
+	f.received = append(f.received, info.IdempotencyKey)
+	fail := len(f.received) <= f.failures
+	f.Unlock()
+
+	if !fail {
+		return req, nil
+	}
+	if f.code == OK {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return nil, Errorf(f.code, "attempt failed")
+}
+
+func (f *flakyServer) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]string(nil), f.received...)
+}
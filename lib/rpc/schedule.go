@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// GoAfter calls the method asynchronously after the delay, the request is
+// published deferred, nsqd holds it until the delay passes, the Done
+// channel of the returned call receives it when it's done
+// the deadline of the context is the timeout of the call, it starts after
+// the delay, so a call with 10 minutes delay and 5 seconds timeout can
+// get its reply in 10 minutes and 5 seconds, the cancellation of the
+// context completes the call any time
+func (c *Client) GoAfter(ctx context.Context, delay time.Duration, typ string, req []byte, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+
+	call := &Call{Method: typ, Request: req, Done: done, ctx: ctx, delay: delay}
+	c.schedule(call)
+	return call
+}
+
+// GoFuncAfter is the same as the GoAfter, but the callback is called with
+// the call when it's done, it must not block
+func (c *Client) GoFuncAfter(ctx context.Context, delay time.Duration, typ string, req []byte, callback func(*Call)) *Call {
+	call := &Call{Method: typ, Request: req, ctx: ctx, delay: delay, callback: callback}
+	c.schedule(call)
+	return call
+}
+
+// NotifyAfter sends a one-way message to the method, which is delivered
+// after the delay, the deadline of the context is the time-to-live of the
+// message after the delay, it returns after the message published
+func (c *Client) NotifyAfter(ctx context.Context, delay time.Duration, typ string, body []byte) error {
+	if err := c.deferrable(delay); err != nil {
+		return err
+	}
+	return c.notify(ctx, c.reqTopic, typ, body, delay)
+}
+
+// schedule starts the call if the publisher can defer it
+func (c *Client) schedule(call *Call) {
+	if err := c.deferrable(call.delay); err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+	c.start(call)
+}
+
+// deferrable returns an error if the message can't be published with the
+// delay
+func (c *Client) deferrable(delay time.Duration) error {
+	if delay < 0 {
+		return Errorf(InvalidArgument, "negative delay: %s", delay)
+	}
+	if _, ok := c.publisher.(DeferredPublisher); delay > 0 && !ok {
+		return Errorf(Unimplemented, "publisher can't defer messages")
+	}
+	return nil
+}
+
+// publishAfter publishes the message deferred by the delay, without delay
+// it's a normal publish
+func (c *Client) publishAfter(topic string, delay time.Duration, body []byte) error {
+	if delay <= 0 {
+		return c.publisher.Publish(topic, body)
+	}
+	return c.publisher.(DeferredPublisher).DeferredPublish(topic, delay, body)
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDelayedDeadline(t *testing.T) {
+	now := time.Now()
+	e := &Envelope{Format: FormatBinary}
+	e.setDeadline(now, now.Add(100*time.Millisecond))
+	e.setDelay(time.Second)
+
+	e2, err := Decode(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2.Delay != 1000 {
+		t.Errorf("delay should be 1000, instead of %d", e2.Delay)
+	}
+
+	// the TTL starts when the delay passed
+	d, ok := e2.deadline(now.Add(time.Second), time.Time{}, 0)
+	if !ok {
+		t.Fatal("delayed message should have deadline")
+	}
+	if want := now.Add(1100 * time.Millisecond); d.Sub(want) > time.Millisecond || want.Sub(d) > time.Millisecond {
+		t.Errorf("deadline should be %v, instead of %v", want, d)
+	}
+
+	// the peers without SentAt and TTL see the shifted ExpiresAt
+	old := &Envelope{ExpiresAt: e2.ExpiresAt}
+	if d, _ := old.deadline(now, time.Time{}, 0); d.Before(now.Add(1100 * time.Millisecond)) {
+		t.Errorf("shifted deadline should be after the delay, instead of %v", d)
+	}
+}
+
+func TestGoAfter(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	// the timeout is shorter than the delay, it starts after the delay
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	call := <-c.GoAfter(ctx, 1200*time.Millisecond, "Echo", []byte("later"), nil).Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if string(call.Reply) != "later" {
+		t.Errorf("reply should be later, instead of %s", call.Reply)
+	}
+	if elapsed := time.Since(start); elapsed < 1200*time.Millisecond {
+		t.Errorf("call should be delayed, instead of replied in %v", elapsed)
+	}
+}
+
+func TestGoAfterTimeout(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &blockingServer{started: make(chan struct{}), done: make(chan error, 1)}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	call := <-c.GoAfter(ctx, 100*time.Millisecond, "Block", nil, nil).Done
+	if call.Error != context.DeadlineExceeded {
+		t.Errorf("call should time out, instead of %v", call.Error)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("timeout should start after the delay, instead of %v", elapsed)
+	}
+	select {
+	case <-srv.started:
+	case <-time.After(time.Second):
+		t.Error("server should get the delayed request")
+	}
+}
+
+func TestNotifyAfter(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	srv := &notifiedServer{received: make(chan *RequestInfo, 1)}
+	lb.subscribe("request", NewServer(context.Background(), srv, lb))
+
+	start := time.Now()
+	if err := c.NotifyAfter(context.Background(), 100*time.Millisecond, "Expire", []byte("session-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case info := <-srv.received:
+		if info.Method != "Expire" {
+			t.Errorf("server should get Expire, instead of %s", info.Method)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("notification should be delayed, instead of delivered in %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server should get the notification")
+	}
+}
+
+func TestScheduleUnimplemented(t *testing.T) {
+	c := NewClient(publishOnly{newLoopback()}, "request", "response")
+
+	if err := c.NotifyAfter(context.Background(), time.Second, "Expire", nil); CodeOf(err) != Unimplemented {
+		t.Errorf("notification without deferred publish should be Unimplemented, instead of %v", err)
+	}
+	call := <-c.GoAfter(context.Background(), time.Second, "Echo", nil, nil).Done
+	if CodeOf(call.Error) != Unimplemented {
+		t.Errorf("call without deferred publish should be Unimplemented, instead of %v", call.Error)
+	}
+	if err := c.NotifyAfter(context.Background(), -time.Second, "Expire", nil); CodeOf(err) != InvalidArgument {
+		t.Errorf("negative delay should be InvalidArgument, instead of %v", err)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/PumpkinSeed/npc/lib/common"
 	"github.com/nsqio/go-nsq"
 )
 
@@ -35,17 +37,104 @@ type Server struct {
 	// ctx is the
 	ctx      context.Context
 	srv      AppServer
-	producer *nsq.Producer
+	producer Publisher
+
+	// compression threshold of the reply bodies
+	compression int
+
+	// skew is the tolerated clock difference between the client and the server
+	skew time.Duration
+
+	// interceptors wrap the srv
+	interceptors []ServerInterceptor
+
+	// dedup stores the replies of the served requests
+	dedup DedupStore
+
+	// inflight stores the requests in progress, so they can be cancelled
+	// streams stores the client streams in progress by the same key
+	// reserved stores the dedup keys of the requests in progress
+	inflight   inflight
+	streams    map[string]*streamWriter
+	reserved   map[string]struct{}
+	inflightMu sync.Mutex
+
+	// streamTopic is the private topic of the frames of the client streams
+	streamTopic string
+
+	// window is the number of frames the clients can send ahead
+	window uint64
+
+	// gapTimeout is the time the client streams wait for a missing frame
+	gapTimeout time.Duration
+
+	// replyRequired are the methods which can't be notified
+	replyRequired map[string]bool
+
+	// deadLetterTopic gets the messages which can't be served
+	// maxAttempts is the number of deliveries before a message is dead
+	deadLetterTopic string
+	maxAttempts     uint16
+
+	// logger gets the errors which can't be returned to the consumer
+	logger common.Logger
 }
 
 // NewServer creates new rpc server for appServer
 // producer will be used for sending replies
-func NewServer(ctx context.Context, srv AppServer, producer *nsq.Producer) *Server {
+func NewServer(ctx context.Context, srv AppServer, producer Publisher) *Server {
 	return &Server{
 		ctx:      ctx,
 		srv:      srv,
 		producer: producer,
+		inflight: make(inflight),
+		streams:  make(map[string]*streamWriter),
+		reserved: make(map[string]struct{}),
+
+		window:     defaultStreamWindow,
+		gapTimeout: defaultGapTimeout,
+	}
+}
+
+// SetCompression turns on the snappy compression of the reply bodies
+// at least threshold bytes long, zero turns it off
+func (s *Server) SetCompression(threshold int) {
+	s.compression = threshold
+}
+
+// SetLogger sets the logger of the errors which can't be returned to the
+// consumer, e.g. the lost dead letters, nil turns it off
+func (s *Server) SetLogger(logger common.Logger) {
+	s.logger = logger
+}
+
+// SetClockSkew sets the tolerated clock difference between the clients
+// and the server, the requests expire that much later than the deadline
+// of the client, so valid requests aren't dropped on early server clocks
+func (s *Server) SetClockSkew(skew time.Duration) {
+	s.skew = skew
+}
+
+// Use appends the interceptors to the chain wrapping the AppServer, the
+// first one is the outermost, it should be called before serving
+func (s *Server) Use(interceptors ...ServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// serve calls the AppServer through the interceptor chain, the streamed
+// requests are served by the ServeStream with the stream
+func (s *Server) serve(ctx context.Context, req *Envelope, stream *streamWriter) ([]byte, error) {
+	h := func(ctx context.Context, req *Envelope) ([]byte, error) {
+		if stream != nil {
+			return s.serveStream(ctx, req, stream)
+		}
+		return s.srv.Serve(ctx, req.Method, req.Body)
 	}
+	if len(s.interceptors) == 0 {
+		return h(ctx, req)
+	}
+
+	return chainServer(s.interceptors, h)(ctx, req)
 }
 
 // HandleMessage server side handler, if there is a consumed message the
@@ -66,27 +155,115 @@ func (s *Server) HandleMessage(m *nsq.Message) error {
 	// occur and break the execution
 	req, err := Decode(m.Body)
 	if err != nil {
+		// the message goes to the dead-letter topic if there is, it's
+		// requeued only if that publish failed
+		if err := s.deadLetter(m, nil, ReasonUndecodable, err); err != nil {
+			return err
+		}
+
 		// raise error without message requeue provided by the fin function
 		// ensure the message won't requeue because the invalid body format
 		fin()
 		return errors.New("envelope unpack failed: " + err.Error())
 	}
 
+	// the client cancelled a request, it's served maybe by this instance
+	if req.Kind == KindCancel {
+		s.cancel(req)
+		return nil
+	}
+
 	// check expiration, if it's expired it's also provide an error, because
 	// in this case the client is no longer waiting for the answer
-	if req.Expired() {
-		fin() // @todo figure out to requeue
+	now := time.Now()
+	deadline, ok := req.deadline(now, time.Unix(0, m.Timestamp), s.skew)
+	if ok && !now.Before(deadline) {
+		if err := s.deadLetter(m, req, ReasonExpired, nil); err != nil {
+			return err
+		}
+		fin()
 		return fmt.Errorf("expired %s %d", req.Method, req.CorrelationID)
 	}
 
+	// the message requeued or failed too many times, e.g. the appServer
+	// keeps postponing it, it's not served again
+	if s.exhausted(m) {
+		if err := s.deadLetter(m, req, ReasonExhausted, nil); err != nil {
+			return err
+		}
+		fin()
+		return fmt.Errorf("exhausted %s %d after %d attempts", req.Method, req.CorrelationID, m.Attempts)
+	}
+
+	// the notifications of the methods which require reply are dropped
+	if err := s.rejected(req); err != nil {
+		fin()
+		return err
+	}
+
+	// a redelivered or retried request which is being served is requeued
+	// until the first delivery ends, then it gets the stored reply or it's
+	// served again if the first one failed
+	key := s.dedupKey(m, req)
+	unreserve, ok := s.reserve(key)
+	if !ok {
+		m.RequeueWithoutBackoff(requeueDelay)
+		return nil
+	}
+	defer unreserve()
+
+	// a redelivered or retried request which is already served gets the
+	// same reply again, without calling the appServer
+	if rsp, ok := s.served(key); ok {
+		if rsp == nil || req.ReplyTo == "" {
+			return nil
+		}
+
+		// the retried request has a new correlation id
+		rsp.CorrelationID = req.CorrelationID
+		rsp.Format = req.Format
+		rsp.Compress(s.compression)
+		if err := s.producer.Publish(req.ReplyTo, rsp.Encode()); err != nil {
+			return errors.New("nsq publish failed: " + err.Error())
+		}
+		return nil
+	}
+
 	// periodically call touch on the nsq message while app is still processing it
 	// issue what it solve in long-running consumers provided at the function definition
 	// important it's call
 	defer touchMessage(s.ctx, m)()
 
+	// every request has its own context, cancelled when the request expires
+	// so the appServer can abort the work nobody waits for
+	ctx, cancel := requestContext(s.ctx, m, req, deadline)
+	defer cancel()
+	defer s.track(req, cancel)()
+
+	// the content type and the header of the request are available for
+	// the appServer, it can set the header of the reply as well
+	ctx, rspHeader := withIncomingHeader(ctx, req.Header)
+	if req.ContentType != "" {
+		ctx = WithContentType(ctx, req.ContentType)
+	}
+
 	// call the user defined entry point to get the response of the request
 	// provide err and response from the appServer
-	appRsp, appErr := s.srv.Serve(s.ctx, req.Method, req.Body)
+	// the streamed requests get the server side of the stream, the client
+	// streams get the first credit of the client as well
+	stream, release, err := s.newStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	appRsp, appErr := s.serve(ctx, req, stream)
+
+	// the client cancelled the request, nobody waits for the reply
+	if s.ctx.Err() == nil && ctx.Err() == context.Canceled {
+		fin()
+		return fmt.Errorf("cancelled %s %d", req.Method, req.CorrelationID)
+	}
 
 	// context timeout/cancel
 	// notice that we are also requeuing on appErr == context.Cancel
@@ -96,19 +273,41 @@ func (s *Server) HandleMessage(m *nsq.Message) error {
 		return nil
 	}
 
+	// the request expired while the appServer worked on it, the client
+	// no longer waits for the reply
+	if ctx.Err() == context.DeadlineExceeded {
+		fin()
+		return fmt.Errorf("expired %s %d", req.Method, req.CorrelationID)
+	}
+
 	// need to reply so if the replyTo is empty it will keep on hold the client
 	// because there isn't reply topic
 	if req.ReplyTo == "" {
+		if appErr == nil {
+			s.remember(key, nil)
+		}
 		return nil
 	}
 
 	// the Envelope has a Reply method which creates the response of the rpc call
 	rsp := req.Reply(appRsp, appErr)
+	rsp.Header = rspHeader.header()
+	if stream != nil {
+		stream.end(rsp)
+	}
+	rsp.Compress(s.compression)
+	buf := rsp.Encode()
+
+	// only the successful replies are stored, the failed requests can be
+	// retried
+	if appErr == nil {
+		s.remember(key, buf)
+	}
 
 	// the producer of the server sends the Envelope response to the reply topic
 	// the producer defined on the initial level, passed as a pointer for the
 	// reusability, and memory safe workflow
-	if err := s.producer.Publish(req.ReplyTo, rsp.Encode()); err != nil {
+	if err := s.producer.Publish(req.ReplyTo, buf); err != nil {
 		return errors.New("nsq publish failed: " + err.Error())
 	}
 	return nil
@@ -120,13 +319,17 @@ func touchMessage(ctx context.Context, m *nsq.Message) func() {
 	// creates a new context with cancel and put it
 	// into the periodical call and touch the message
 	// in every touchInterval
+	// the ticker created before the goroutine, so concurrent handlers
+	// use the interval in effect when their message arrived
 	ctxTouch, cancel := context.WithCancel(ctx)
+	ticker := time.NewTicker(touchInterval)
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctxTouch.Done():
 				return
-			case <-time.After(touchInterval):
+			case <-ticker.C:
 				m.Touch()
 			}
 		}
@@ -3,12 +3,14 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -220,3 +222,105 @@ func (s *server) Serve(ctx context.Context, method string, reqBuf []byte) ([]byt
 func (s *server) add(x, y int) int {
 	return x + y
 }
+
+/*
+	The following tests run on the in-memory loopback publisher
+*/
+
+func TestHandleMessageConcurrent(t *testing.T) {
+	defer func(d time.Duration) { touchInterval = d }(touchInterval)
+	touchInterval = 10 * time.Millisecond
+
+	const n = 8
+	lb := newLoopback()
+	replies := make(chan *Envelope, n)
+	lb.subscribe("response", nsq.HandlerFunc(func(m *nsq.Message) error {
+		rsp, err := Decode(m.Body)
+		if err != nil {
+			return err
+		}
+		replies <- rsp
+		return nil
+	}))
+
+	// barrier app server, it replies only if all the requests are in progress
+	app := &barrierServer{n: n, all: make(chan struct{})}
+	srv := NewServer(context.Background(), app, lb)
+
+	var handlers sync.WaitGroup
+	messages := make([]*nsq.Message, n)
+	for i := range messages {
+		req := &Envelope{Method: "Wait", ReplyTo: "response", CorrelationID: uint32(i)}
+		messages[i] = newMessage(uint64(i), req.Encode())
+
+		handlers.Add(1)
+		go func(m *nsq.Message) {
+			defer handlers.Done()
+			deliver(srv, m)
+		}(messages[i])
+	}
+	handlers.Wait()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-replies:
+		case <-time.After(time.Second):
+			t.Fatalf("reply %d missing", i)
+		}
+	}
+
+	for i, m := range messages {
+		d := m.Delegate.(*delegate)
+		if atomic.LoadInt32(&d.finished) != 1 {
+			t.Errorf("message %d should be finished once, instead of %d", i, d.finished)
+		}
+		if atomic.LoadInt32(&d.touched) == 0 {
+			t.Errorf("message %d should be touched", i)
+		}
+	}
+}
+
+func TestHandleMessageRequeue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv := NewServer(ctx, echoServer{}, newLoopback())
+
+	for i := 0; i < 4; i++ {
+		req := &Envelope{Method: "Echo", ReplyTo: "response", CorrelationID: uint32(i)}
+		m := newMessage(uint64(i), req.Encode())
+		deliver(srv, m)
+
+		d := m.Delegate.(*delegate)
+		if d.requeued != 1 || d.finished != 0 {
+			t.Errorf("message %d should be requeued, requeued %d finished %d", i, d.requeued, d.finished)
+		}
+		if d.delay != requeueDelay {
+			t.Errorf("requeue delay should be %s, instead of %s", requeueDelay, d.delay)
+		}
+	}
+}
+
+// barrierServer blocks all the requests until n of them are in progress
+type barrierServer struct {
+	sync.Mutex
+	n   int
+	all chan struct{}
+}
+
+func (b *barrierServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	b.Lock()
+	b.n--
+	if b.n == 0 {
+		close(b.all)
+	}
+	b.Unlock()
+
+	select {
+	case <-b.all:
+		// wait a bit longer than the touch interval
+		time.Sleep(3 * touchInterval)
+		return req, nil
+	case <-time.After(time.Second):
+		return nil, errors.New("requests weren't handled concurrently")
+	}
+}
@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Code is the status code of the remote error, the values are the same
+// as the gRPC codes
+type Code uint32
+
+// Status codes
+const (
+	// OK means no error
+	OK Code = iota
+
+	// Canceled the caller cancelled the operation
+	Canceled
+
+	// Unknown error, errors without status get this code
+	Unknown
+
+	// InvalidArgument the request is invalid regardless of the server state
+	InvalidArgument
+
+	// DeadlineExceeded the operation didn't finish before the deadline
+	DeadlineExceeded
+
+	// NotFound the requested entity was not found
+	NotFound
+
+	// AlreadyExists the entity the client tried to create already exists
+	AlreadyExists
+
+	// PermissionDenied the caller is not allowed to do the operation
+	PermissionDenied
+
+	// ResourceExhausted some resource, e.g. a quota, has been exhausted
+	ResourceExhausted
+
+	// FailedPrecondition the system is not in the state the operation requires
+	FailedPrecondition
+
+	// Aborted the operation was aborted, e.g. because of a conflict
+	Aborted
+
+	// OutOfRange the operation was attempted past the valid range
+	OutOfRange
+
+	// Unimplemented the method is not implemented or not supported
+	Unimplemented
+
+	// Internal error of the server
+	Internal
+
+	// Unavailable the service is currently unavailable, retry may help
+	Unavailable
+
+	// DataLoss unrecoverable data loss or corruption
+	DataLoss
+
+	// Unauthenticated the request has no valid authentication credentials
+	Unauthenticated
+)
+
+var codeNames = [...]string{
+	"OK",
+	"Canceled",
+	"Unknown",
+	"InvalidArgument",
+	"DeadlineExceeded",
+	"NotFound",
+	"AlreadyExists",
+	"PermissionDenied",
+	"ResourceExhausted",
+	"FailedPrecondition",
+	"Aborted",
+	"OutOfRange",
+	"Unimplemented",
+	"Internal",
+	"Unavailable",
+	"DataLoss",
+	"Unauthenticated",
+}
+
+// String returns the name of the code
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status is the structured error of the remote call, the AppServer can
+// return it and the client gets it back, so it can be inspected with
+// errors.As on the client side
+type Status struct {
+	// Code classifies the error
+	Code Code
+
+	// Message describes the error for humans
+	Message string
+
+	// Details stores the structured data of the error
+	Details map[string]string
+}
+
+// Errorf creates a status with the code and the formatted message
+func Errorf(code Code, format string, args ...interface{}) *Status {
+	return &Status{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error returns the message, the same as the error had on the server
+func (s *Status) Error() string {
+	return s.Message
+}
+
+// WithDetail sets a detail of the status and returns the status
+func (s *Status) WithDetail(key, value string) *Status {
+	if s.Details == nil {
+		s.Details = make(map[string]string)
+	}
+	s.Details[key] = value
+	return s
+}
+
+// StatusOf converts the error into status, the context errors get their
+// own codes, other errors without status the Unknown, nil stays nil
+func StatusOf(err error) *Status {
+	if err == nil {
+		return nil
+	}
+
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+
+	switch err {
+	case context.DeadlineExceeded:
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	case context.Canceled:
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// CodeOf returns the code of the error, OK for nil
+func CodeOf(err error) Code {
+	if s := StatusOf(err); s != nil {
+		return s.Code
+	}
+	return OK
+}
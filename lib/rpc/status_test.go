@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCodeString(t *testing.T) {
+	if s := NotFound.String(); s != "NotFound" {
+		t.Errorf("name should be NotFound, instead of %s", s)
+	}
+	if s := Code(100).String(); s != "Code(100)" {
+		t.Errorf("name should be Code(100), instead of %s", s)
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	st := Errorf(NotFound, "user %d", 42)
+	wrapped := fmt.Errorf("lookup: %w", st)
+
+	for err, code := range map[error]Code{
+		st:                       NotFound,
+		wrapped:                  NotFound,
+		context.DeadlineExceeded: DeadlineExceeded,
+		context.Canceled:         Canceled,
+		errors.New("plain"):      Unknown,
+	} {
+		if c := CodeOf(err); c != code {
+			t.Errorf("code of %v should be %s, instead of %s", err, code, c)
+		}
+	}
+
+	if StatusOf(nil) != nil || CodeOf(nil) != OK {
+		t.Error("nil error should have no status")
+	}
+}
+
+func TestReplyStatus(t *testing.T) {
+	req := &Envelope{CorrelationID: 322232}
+
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		req.Format = f
+		rsp := req.Reply(nil, Errorf(InvalidArgument, "x is negative").WithDetail("field", "x"))
+
+		decoded, err := Decode(rsp.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var st *Status
+		if !errors.As(decoded.Err(), &st) {
+			t.Fatalf("error should be status, instead of %v", decoded.Err())
+		}
+		if st.Code != InvalidArgument || st.Message != "x is negative" || st.Details["field"] != "x" {
+			t.Errorf("status should be decoded, instead of %+v", st)
+		}
+	}
+}
+
+func TestReplyStatusCompatibility(t *testing.T) {
+	// the older servers send only the message
+	rsp := &Envelope{Error: "failed"}
+	if c := CodeOf(rsp.Err()); c != Unknown {
+		t.Errorf("code should be Unknown, instead of %s", c)
+	}
+
+	// the older clients check only the message
+	rsp = (&Envelope{}).Reply(nil, &Status{Code: Internal})
+	if rsp.Error != "Internal" {
+		t.Errorf("message should be the code name, instead of %s", rsp.Error)
+	}
+
+	if err := (&Envelope{Body: []byte("ok")}).Err(); err != nil {
+		t.Errorf("successful reply shouldn't have error, instead of %v", err)
+	}
+}
+
+func TestDoStatus(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), r, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := c.Do(ctx, "Arith.Sub", []byte("{}"))
+	if c := CodeOf(err); c != Unimplemented {
+		t.Errorf("code should be Unimplemented, instead of %s: %v", c, err)
+	}
+
+	_, err = c.Do(ctx, "Arith.Add", []byte("{"))
+	if c := CodeOf(err); c != InvalidArgument {
+		t.Errorf("code should be InvalidArgument, instead of %s: %v", c, err)
+	}
+
+	// the failed publish is retryable
+	_, err = NewClient(newLoopback(), "request", "response").Do(ctx, "Arith.Add", nil)
+	if c := CodeOf(err); c != Unavailable {
+		t.Errorf("code should be Unavailable, instead of %s: %v", c, err)
+	}
+}
@@ -0,0 +1,644 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+var (
+	// ErrStreamClosed returned by the stream after it's closed
+	ErrStreamClosed = errors.New("stream closed")
+
+	// defaultGapTimeout is the time the streams wait for a missing frame
+	defaultGapTimeout = 5 * time.Second
+
+	// defaultStreamWindow is the number of the frames the client can send
+	// ahead of the server
+	defaultStreamWindow uint64 = 32
+)
+
+// StreamServer is implemented by the AppServers with streamed replies, the
+// streamed requests are served by ServeStream instead of Serve, the
+// returned error closes the stream
+type StreamServer interface {
+	ServeStream(ctx context.Context, method string, req []byte, w StreamWriter) error
+}
+
+// StreamWriter sends the frames of the streamed reply
+type StreamWriter interface {
+	Send(body []byte) error
+}
+
+// BidiServer is implemented by the AppServers with client streams or
+// bidirectional streams, the returned error closes the stream
+type BidiServer interface {
+	ServeBidi(ctx context.Context, method string, s ServerStream) error
+}
+
+// ServerStream receives the frames of the client and sends the frames of
+// the reply, Recv returns io.EOF after the client closed its side
+type ServerStream interface {
+	StreamWriter
+	Recv() ([]byte, error)
+}
+
+// frameBuffer orders the frames of a stream by their sequence numbers,
+// the frames arrived out of order wait for the missing ones, the
+// duplicates are dropped
+type frameBuffer struct {
+	mu     sync.Mutex
+	next   uint64
+	frames map[uint64]*Envelope
+	err    error
+	notify chan struct{}
+}
+
+func newFrameBuffer() *frameBuffer {
+	return &frameBuffer{
+		next:   1,
+		frames: make(map[uint64]*Envelope),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push adds the frame to the buffer
+func (b *frameBuffer) push(frame *Envelope) {
+	b.mu.Lock()
+	if _, dup := b.frames[frame.Seq]; b.err != nil || dup || frame.Seq < b.next {
+		b.mu.Unlock()
+		return
+	}
+	b.frames[frame.Seq] = frame
+	b.mu.Unlock()
+
+	b.wake()
+}
+
+// pop returns the next frame if it's already arrived, waiting is true if
+// some of the following frames are waiting for it
+func (b *frameBuffer) pop() (frame *Envelope, waiting bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return nil, false, b.err
+	}
+
+	frame, ok := b.frames[b.next]
+	if !ok {
+		return nil, len(b.frames) > 0, nil
+	}
+	delete(b.frames, b.next)
+	b.next++
+	return frame, false, nil
+}
+
+// wait returns the next frame, it gives up if the next frame is missing
+// for longer than the gap timeout or the context is done
+func (b *frameBuffer) wait(ctx context.Context, gapTimeout time.Duration) (*Envelope, error) {
+	var gap <-chan time.Time
+	for {
+		frame, waiting, err := b.pop()
+		if frame != nil || err != nil {
+			return frame, err
+		}
+
+		// the following frames are here, so the next should arrive soon
+		if waiting && gap == nil {
+			t := time.NewTimer(gapTimeout)
+			defer t.Stop()
+			gap = t.C
+		}
+
+		select {
+		case <-b.notify:
+		case <-gap:
+			return nil, Errorf(DataLoss, "stream frame %d missing", b.next)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// close fails the buffer with the error, the first error is kept
+func (b *frameBuffer) close(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+		b.frames = nil
+	}
+	b.mu.Unlock()
+
+	b.wake()
+}
+
+// failure returns the error of the closed buffer
+func (b *frameBuffer) failure() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.err
+}
+
+// wake notifies the waiting reader
+func (b *frameBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// streamWriter is the server side of the streams, it publishes the
+// frames of the reply to the reply topic of the request, and for the
+// client streams it receives the frames of the client
+type streamWriter struct {
+	sync.Mutex
+
+	s      *Server
+	req    *Envelope
+	seq    uint64
+	closed bool
+
+	// the frames of the client, nil for the server-streaming requests
+	ctx     context.Context
+	in      *frameBuffer
+	allowed uint64
+}
+
+// Send publishes the next frame of the stream
+func (w *streamWriter) Send(body []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrStreamClosed
+	}
+	if w.req.ReplyTo == "" {
+		return nil
+	}
+
+	frame := &Envelope{
+		Kind:          KindStream,
+		CorrelationID: w.req.CorrelationID,
+		Seq:           w.seq + 1,
+		ContentType:   w.req.ContentType,
+		Format:        w.req.Format,
+		Body:          body,
+	}
+	frame.Compress(w.s.compression)
+
+	// the sequence number is taken only by the published frames, so a
+	// failed Send doesn't leave a gap behind
+	if err := w.s.producer.Publish(w.req.ReplyTo, frame.Encode()); err != nil {
+		return errors.New("nsq publish failed: " + err.Error())
+	}
+	w.seq = frame.Seq
+	return nil
+}
+
+// Recv returns the body of the next frame of the client, io.EOF after
+// the client closed its side
+func (w *streamWriter) Recv() ([]byte, error) {
+	if w.in == nil {
+		return nil, io.EOF
+	}
+
+	frame, err := w.in.wait(w.ctx, w.s.gapTimeout)
+	if err != nil {
+		w.in.close(err)
+		return nil, w.in.failure()
+	}
+	if frame.Kind == KindEnd {
+		w.in.close(io.EOF)
+		return nil, io.EOF
+	}
+
+	// the client gets more credit when it used half of the window
+	if w.allowed-frame.Seq <= w.s.window/2 {
+		if err := w.grant(frame.Seq + w.s.window); err != nil {
+			return nil, err
+		}
+	}
+	return frame.Body, nil
+}
+
+// grant lets the client send the frames up to the seq, the credit is
+// cumulative, so a reordered or duplicated credit does no harm
+func (w *streamWriter) grant(seq uint64) error {
+	credit := &Envelope{
+		Kind:          KindCredit,
+		ReplyTo:       w.s.streamTopic,
+		CorrelationID: w.req.CorrelationID,
+		Seq:           seq,
+		Format:        w.req.Format,
+	}
+	if err := w.s.producer.Publish(w.req.ReplyTo, credit.Encode()); err != nil {
+		return errors.New("nsq publish failed: " + err.Error())
+	}
+
+	w.allowed = seq
+	return nil
+}
+
+// end turns the reply into the end of the stream, no more frames after it
+func (w *streamWriter) end(rsp *Envelope) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.closed = true
+	rsp.Kind = KindEnd
+	rsp.Seq = w.seq + 1
+}
+
+// SetStreamTopic sets the private topic of the server instance, the
+// clients send the frames of their streams to it, it's consumed by the
+// StreamHandler, without it the client streams aren't supported
+func (s *Server) SetStreamTopic(topic string) {
+	s.streamTopic = topic
+}
+
+// SetStreamWindow sets the number of the frames the clients can send
+// ahead of the server
+func (s *Server) SetStreamWindow(n int) {
+	if n > 0 {
+		s.window = uint64(n)
+	}
+}
+
+// SetGapTimeout sets how long the client streams wait for a missing frame
+// after the following ones arrived, then the stream fails with DataLoss
+func (s *Server) SetGapTimeout(d time.Duration) {
+	s.gapTimeout = d
+}
+
+// StreamHandler returns the handler of the stream topic, it passes the
+// frames of the clients to their streams
+func (s *Server) StreamHandler() nsq.Handler {
+	return nsq.HandlerFunc(func(m *nsq.Message) error {
+		frame, err := Decode(m.Body)
+		if err != nil {
+			m.DisableAutoResponse()
+			m.Finish()
+			return errors.New("envelope unpack failed: " + err.Error())
+		}
+
+		key := inflightKey(frame.ReplyTo, frame.CorrelationID)
+		s.inflightMu.Lock()
+		w, ok := s.streams[key]
+		s.inflightMu.Unlock()
+
+		// the stream is already over
+		if !ok {
+			m.DisableAutoResponse()
+			m.Finish()
+			return fmt.Errorf("stream not found for %d", frame.CorrelationID)
+		}
+
+		w.in.push(frame)
+		return nil
+	})
+}
+
+// newStream creates the server side of the streamed request, nil if the
+// request isn't streamed, the client streams are registered until the
+// returned function called and the client gets the first credit
+func (s *Server) newStream(ctx context.Context, req *Envelope) (*streamWriter, func(), error) {
+	switch {
+	case req.Kind == KindStream:
+		return &streamWriter{s: s, req: req}, func() {}, nil
+	case req.Kind != KindOpen:
+		return nil, func() {}, nil
+	case s.streamTopic == "" || req.ReplyTo == "":
+		// serveStream rejects it
+		return &streamWriter{s: s, req: req}, func() {}, nil
+	}
+
+	w := &streamWriter{s: s, req: req, ctx: ctx, in: newFrameBuffer()}
+	key := inflightKey(req.ReplyTo, req.CorrelationID)
+
+	s.inflightMu.Lock()
+	s.streams[key] = w
+	s.inflightMu.Unlock()
+
+	release := func() {
+		s.inflightMu.Lock()
+		delete(s.streams, key)
+		s.inflightMu.Unlock()
+	}
+
+	if err := w.grant(s.window); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return w, release, nil
+}
+
+// serveStream calls the ServeStream or the ServeBidi of the AppServer
+func (s *Server) serveStream(ctx context.Context, req *Envelope, w *streamWriter) ([]byte, error) {
+	if req.Kind == KindOpen {
+		bs, ok := s.srv.(BidiServer)
+		if !ok || w.in == nil {
+			return nil, Errorf(Unimplemented, "client streaming not supported: %s", req.Method)
+		}
+		return nil, bs.ServeBidi(ctx, req.Method, w)
+	}
+
+	ss, ok := s.srv.(StreamServer)
+	if !ok {
+		return nil, Errorf(Unimplemented, "streaming not supported: %s", req.Method)
+	}
+	return nil, ss.ServeStream(ctx, req.Method, req.Body, w)
+}
+
+// ClientStream receives the frames of a streamed reply in order, the
+// frames delivered out of order by nsq are buffered until the missing
+// ones arrive, the duplicates are dropped, the streams opened by the
+// OpenStream can send frames to the server as well
+// the stream must be read until the end or closed, Recv and Send can be
+// called concurrently, but not Recv with Recv or Send with Send
+type ClientStream struct {
+	c        *Client
+	ctx      context.Context
+	reqTopic string
+	req      *Envelope
+	in       *frameBuffer
+
+	// the sending side, the server grants credit for the frames
+	sendMu     sync.Mutex
+	sent       uint64
+	sendClosed bool
+
+	// the credit of the server, the allowed is the last seq to send
+	creditMu  sync.Mutex
+	sendTopic string
+	allowed   uint64
+	credit    chan struct{}
+
+	done chan struct{}
+	once sync.Once
+}
+
+// SetGapTimeout sets how long the streams wait for a missing frame after
+// the following ones arrived, then the stream fails with DataLoss
+func (c *Client) SetGapTimeout(d time.Duration) {
+	c.gapTimeout = d
+}
+
+// Stream calls the method with streamed reply
+func (c *Client) Stream(ctx context.Context, typ string, req []byte) (*ClientStream, error) {
+	return c.StreamTopic(ctx, c.reqTopic, typ, req)
+}
+
+// StreamTopic is the same as the Stream, but it gets the topic to send
+// the request, the deadline of the context covers the whole stream
+func (c *Client) StreamTopic(ctx context.Context, reqTopic, typ string, req []byte) (*ClientStream, error) {
+	eReq := c.request(ctx, typ, req)
+	eReq.Kind = KindStream
+	return c.openStream(ctx, reqTopic, eReq)
+}
+
+// OpenStream opens a client stream or a bidirectional stream to the
+// method, the client sends the frames by Send and closes its side by
+// CloseSend, the frames of the server are received by Recv
+func (c *Client) OpenStream(ctx context.Context, typ string) (*ClientStream, error) {
+	return c.OpenStreamTopic(ctx, c.reqTopic, typ)
+}
+
+// OpenStreamTopic is the same as the OpenStream, but it gets the topic
+// to send the request, the deadline of the context covers the whole stream
+func (c *Client) OpenStreamTopic(ctx context.Context, reqTopic, typ string) (*ClientStream, error) {
+	eReq := c.request(ctx, typ, nil)
+	eReq.Kind = KindOpen
+	return c.openStream(ctx, reqTopic, eReq)
+}
+
+// openStream subscribes the stream and sends the request of it, the
+// correlation id of the request is the id of the stream
+func (c *Client) openStream(ctx context.Context, reqTopic string, eReq *Envelope) (*ClientStream, error) {
+	eReq.CorrelationID = c.correlationID()
+
+	s := &ClientStream{
+		c:        c,
+		ctx:      ctx,
+		reqTopic: reqTopic,
+		req:      eReq,
+		in:       newFrameBuffer(),
+		credit:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	// the stream subscribed before the request is sent, so the first
+	// frames can't be missed
+	c.addStream(eReq.CorrelationID, s)
+	if err := c.send(ctx, reqTopic, 0, eReq); err != nil {
+		c.removeStream(eReq.CorrelationID)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Recv returns the body of the next frame, io.EOF at the end of the
+// stream, or the error the server closed the stream with
+func (s *ClientStream) Recv() ([]byte, error) {
+	frame, err := s.in.wait(s.ctx, s.c.gapTimeout)
+	if err != nil {
+		// the server is told to stop, unless it's just expired
+		s.finish(err, err != context.DeadlineExceeded)
+		return nil, s.in.failure()
+	}
+
+	if frame.Kind != KindEnd {
+		return frame.Body, nil
+	}
+
+	// the header of the reply arrives with the end of the stream
+	collectReplyHeader(s.ctx, frame.Header)
+	err = frame.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	s.finish(err, false)
+	return nil, s.in.failure()
+}
+
+// Send sends the next frame to the server, it blocks while the server
+// hasn't granted credit for it, io.EOF is returned if the server already
+// ended the stream, Recv returns the error of it
+func (s *ClientStream) Send(body []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if err := s.waitCredit(true); err != nil {
+		return err
+	}
+
+	frame := &Envelope{
+		Kind:          KindStream,
+		ReplyTo:       s.req.ReplyTo,
+		CorrelationID: s.req.CorrelationID,
+		Seq:           s.sent + 1,
+		ContentType:   s.req.ContentType,
+		Format:        s.req.Format,
+		Body:          body,
+	}
+	frame.Compress(s.c.compression)
+	if err := s.c.publisher.Publish(s.topic(), frame.Encode()); err != nil {
+		return Errorf(Unavailable, "nsq publish failed: %s", err.Error())
+	}
+
+	s.sent = frame.Seq
+	return nil
+}
+
+// CloseSend closes the sending side of the stream, the server gets
+// io.EOF after the last frame
+func (s *ClientStream) CloseSend() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if err := s.waitCredit(false); err != nil {
+		return err
+	}
+
+	frame := &Envelope{
+		Kind:          KindEnd,
+		ReplyTo:       s.req.ReplyTo,
+		CorrelationID: s.req.CorrelationID,
+		Seq:           s.sent + 1,
+		Format:        s.req.Format,
+	}
+	if err := s.c.publisher.Publish(s.topic(), frame.Encode()); err != nil {
+		return Errorf(Unavailable, "nsq publish failed: %s", err.Error())
+	}
+
+	s.sendClosed = true
+	return nil
+}
+
+// waitCredit waits for the topic of the server and the credit of the next
+// frame if it's needed, the caller must hold the sendMu
+func (s *ClientStream) waitCredit(needCredit bool) error {
+	if s.req.Kind != KindOpen {
+		return errors.New("stream of " + s.req.Method + " can't send")
+	}
+
+	for {
+		if s.sendClosed {
+			return ErrStreamClosed
+		}
+		select {
+		case <-s.done:
+			return io.EOF
+		default:
+		}
+
+		s.creditMu.Lock()
+		ready := s.sendTopic != "" && (!needCredit || s.sent < s.allowed)
+		s.creditMu.Unlock()
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-s.credit:
+		case <-s.done:
+		case <-s.ctx.Done():
+			s.finish(s.ctx.Err(), s.ctx.Err() == context.Canceled)
+		}
+	}
+}
+
+// topic returns the stream topic of the server
+func (s *ClientStream) topic() string {
+	s.creditMu.Lock()
+	defer s.creditMu.Unlock()
+
+	return s.sendTopic
+}
+
+// Close stops the stream, the server is told to stop it as well, unless
+// the stream already ended
+func (s *ClientStream) Close() error {
+	s.finish(ErrStreamClosed, true)
+	return nil
+}
+
+// Done is closed when the stream ended or closed
+func (s *ClientStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// deliver passes the frame arrived to the stream
+func (s *ClientStream) deliver(frame *Envelope) {
+	switch frame.Kind {
+	case KindStream, KindEnd:
+		s.in.push(frame)
+	case KindCredit:
+		// the credits are cumulative, the stream topic arrives with them
+		s.creditMu.Lock()
+		s.sendTopic = frame.ReplyTo
+		if frame.Seq > s.allowed {
+			s.allowed = frame.Seq
+		}
+		s.creditMu.Unlock()
+
+		select {
+		case s.credit <- struct{}{}:
+		default:
+		}
+	default:
+		// an older server replies once, like the stream would be a
+		// simple call
+		err := frame.Err()
+		if err == nil {
+			err = Errorf(Unimplemented, "streaming not supported: %s", s.req.Method)
+		}
+		s.finish(err, false)
+	}
+}
+
+// finish ends the stream with the error, the cancel tells the server to
+// stop serving it
+func (s *ClientStream) finish(err error, cancel bool) {
+	s.once.Do(func() {
+		s.in.close(err)
+		s.c.removeStream(s.req.CorrelationID)
+		if cancel {
+			s.c.cancel(s.reqTopic, s.req)
+		}
+		close(s.done)
+	})
+}
+
+// addStream subscribes the stream to its frames
+func (c *Client) addStream(id uint32, s *ClientStream) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.streams[id] = s
+}
+
+// stream returns the stream of the correlation id, it stays subscribed
+// until it's removed
+func (c *Client) stream(id uint32) (*ClientStream, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.streams[id]
+	return s, ok
+}
+
+// removeStream unsubscribes the stream
+func (c *Client) removeStream(id uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.streams, id)
+}
@@ -0,0 +1,327 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestStream(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), countServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := c.Stream(ctx, "Count", []byte("100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the loopback delivers the frames concurrently, so out of order
+	for i := 1; i <= 100; i++ {
+		body, err := s.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != fmt.Sprint(i) {
+			t.Fatalf("frame %d should be %d, instead of %s", i, i, body)
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("stream should end with EOF, instead of %v", err)
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("ended stream should return EOF again, instead of %v", err)
+	}
+	if len(c.streams) != 0 {
+		t.Errorf("streams should be empty, instead of %d", len(c.streams))
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), countServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := c.Stream(ctx, "Count", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); CodeOf(err) != InvalidArgument {
+		t.Errorf("stream should fail with InvalidArgument, instead of %v", err)
+	}
+}
+
+func TestStreamUnimplemented(t *testing.T) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	lb.subscribe("request", NewServer(context.Background(), echoServer{}, lb))
+	lb.subscribe("response", c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := c.Stream(ctx, "Echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); CodeOf(err) != Unimplemented {
+		t.Errorf("stream should fail with Unimplemented, instead of %v", err)
+	}
+}
+
+func TestStreamReorder(t *testing.T) {
+	c, s := newTestStream(t)
+
+	// the frames arrive out of order, with a duplicate
+	for _, seq := range []uint64{3, 1, 1, 4, 2} {
+		frame := &Envelope{Kind: KindStream, CorrelationID: s.req.CorrelationID, Seq: seq, Body: []byte(fmt.Sprint(seq))}
+		if seq == 4 {
+			frame.Kind = KindEnd
+		}
+		c.HandleMessage(newMessage(seq, frame.Encode()))
+	}
+
+	for i := 1; i <= 3; i++ {
+		body, err := s.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != fmt.Sprint(i) {
+			t.Errorf("frame %d should be %d, instead of %s", i, i, body)
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("stream should end with EOF, instead of %v", err)
+	}
+}
+
+func TestStreamGap(t *testing.T) {
+	c, s := newTestStream(t)
+	c.SetGapTimeout(20 * time.Millisecond)
+
+	for _, seq := range []uint64{1, 3} {
+		frame := &Envelope{Kind: KindStream, CorrelationID: s.req.CorrelationID, Seq: seq}
+		c.HandleMessage(newMessage(seq, frame.Encode()))
+	}
+
+	if _, err := s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); CodeOf(err) != DataLoss {
+		t.Errorf("missing frame should be DataLoss, instead of %v", err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("stream should be done")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	c, s := newTestStream(t)
+	s.Close()
+
+	if _, err := s.Recv(); err != ErrStreamClosed {
+		t.Errorf("closed stream should return ErrStreamClosed, instead of %v", err)
+	}
+	if _, found := c.stream(s.req.CorrelationID); found {
+		t.Error("closed stream should be unsubscribed")
+	}
+}
+
+// newTestStream opens a stream without server, the test delivers the frames
+func newTestStream(t *testing.T) (*Client, *ClientStream) {
+	lb := newLoopback()
+	lb.subscribe("request", nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+	c := NewClient(lb, "request", "response")
+	c.SetCancellation(false)
+
+	s, err := c.Stream(context.Background(), "Count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// countServer streams the numbers from 1 to the number in the request
+type countServer struct{}
+
+func (countServer) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	return nil, Errorf(Unimplemented, "only streaming")
+}
+
+func (countServer) ServeStream(ctx context.Context, method string, req []byte, w StreamWriter) error {
+	var n int
+	if _, err := fmt.Sscan(string(req), &n); err != nil {
+		return Errorf(InvalidArgument, "invalid count: %s", req)
+	}
+
+	for i := 1; i <= n; i++ {
+		if err := w.Send([]byte(fmt.Sprint(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBidiStream(t *testing.T) {
+	c, _ := newBidi(sumServer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := c.OpenStream(ctx, "Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := s.Send([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server echoes every frame and sends the sum at the end
+	for i := 1; i <= 100; i++ {
+		body, err := s.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != fmt.Sprint(i) {
+			t.Fatalf("echo %d should be %d, instead of %s", i, i, body)
+		}
+	}
+	if body, err := s.Recv(); err != nil || string(body) != "5050" {
+		t.Errorf("sum should be 5050, instead of %s, %v", body, err)
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("stream should end with EOF, instead of %v", err)
+	}
+	if err := s.Send(nil); err != ErrStreamClosed {
+		t.Errorf("send after CloseSend should be ErrStreamClosed, instead of %v", err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	srv := &gateServer{open: make(chan struct{})}
+	c, s := newBidi(srv)
+	s.SetStreamWindow(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cs, err := c.OpenStream(ctx, "Gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := cs.Send(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the window is full until the server reads
+	sent := make(chan error, 1)
+	go func() {
+		sent <- cs.Send(nil)
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("send should block on the full window, instead of %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(srv.open)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	cs.Close()
+}
+
+func TestBidiUnimplemented(t *testing.T) {
+	c, _ := newBidi(countServer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := c.OpenStream(ctx, "Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); CodeOf(err) != Unimplemented {
+		t.Errorf("stream should fail with Unimplemented, instead of %v", err)
+	}
+	if err := s.Send(nil); err != io.EOF {
+		t.Errorf("send should be EOF, instead of %v", err)
+	}
+}
+
+// newBidi connects a client and a server with stream topic
+func newBidi(srv AppServer) (*Client, *Server) {
+	lb := newLoopback()
+	c := NewClient(lb, "request", "response")
+	s := NewServer(context.Background(), srv, lb)
+	s.SetStreamTopic("stream")
+	lb.subscribe("request", s)
+	lb.subscribe("stream", s.StreamHandler())
+	lb.subscribe(ControlTopic("request"), s)
+	lb.subscribe("response", c)
+	return c, s
+}
+
+// sumServer echoes the numbers of the client and sends the sum of them
+type sumServer struct{ countServer }
+
+func (sumServer) ServeBidi(ctx context.Context, method string, s ServerStream) error {
+	var sum int
+	for {
+		body, err := s.Recv()
+		if err == io.EOF {
+			return s.Send([]byte(fmt.Sprint(sum)))
+		}
+		if err != nil {
+			return err
+		}
+
+		var n int
+		fmt.Sscan(string(body), &n)
+		sum += n
+		if err := s.Send(body); err != nil {
+			return err
+		}
+	}
+}
+
+// gateServer reads the frames of the client after the gate opened
+type gateServer struct {
+	countServer
+	open chan struct{}
+}
+
+func (g *gateServer) ServeBidi(ctx context.Context, method string, s ServerStream) error {
+	select {
+	case <-g.open:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for {
+		if _, err := s.Recv(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// ephemeralSuffix tells nsqd to delete the topic or the channel
+	// when the last consumer disconnected from it
+	ephemeralSuffix = "#ephemeral"
+
+	// maxNameLength is the longest topic or channel name nsqd accepts
+	maxNameLength = 64
+
+	// instanceIDLength is the length of the hex instance identifier
+	instanceIDLength = 16
+
+	// controlSuffix separates the control topic from the request topic
+	controlSuffix = "_control"
+)
+
+// PrivateTopic derives a unique ephemeral reply topic from the base
+// topic name, so the replies of two client instances never mix and
+// nsqd cleans up the topic after the client disconnected
+func PrivateTopic(base string) string {
+	base = strings.TrimSuffix(base, ephemeralSuffix)
+
+	// leave room for the separator, the instance id and the suffix
+	if max := maxNameLength - len(ephemeralSuffix) - instanceIDLength - 1; len(base) > max {
+		base = base[:max]
+	}
+
+	return base + "." + instanceID() + ephemeralSuffix
+}
+
+// PrivateChannel derives a unique ephemeral channel name from the base
+// channel name, so every instance gets all the messages of the topic
+func PrivateChannel(base string) string {
+	return PrivateTopic(base)
+}
+
+// ControlTopic returns the ephemeral topic of the control messages of the
+// request topic, like the cancellations, every server instance consumes
+// it on its own private channel
+func ControlTopic(reqTopic string) string {
+	reqTopic = strings.TrimSuffix(reqTopic, ephemeralSuffix)
+	if max := maxNameLength - len(controlSuffix) - len(ephemeralSuffix); len(reqTopic) > max {
+		reqTopic = reqTopic[:max]
+	}
+
+	return reqTopic + controlSuffix + ephemeralSuffix
+}
+
+// EphemeralChannel returns the ephemeral version of the channel name
+func EphemeralChannel(name string) string {
+	if strings.HasSuffix(name, ephemeralSuffix) {
+		return name
+	}
+	if max := maxNameLength - len(ephemeralSuffix); len(name) > max {
+		name = name[:max]
+	}
+
+	return name + ephemeralSuffix
+}
+
+// instanceID generates a random hex identifier
+func instanceID() string {
+	return randomHex(instanceIDLength / 2)
+}
+
+// randomHex generates n random bytes in hex
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("rpc: crypto/rand failed: " + err.Error())
+	}
+
+	return hex.EncodeToString(buf)
+}
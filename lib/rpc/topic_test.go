@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"strings"
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestPrivateTopic(t *testing.T) {
+	t1 := PrivateTopic("response")
+	t2 := PrivateTopic("response")
+
+	if t1 == t2 {
+		t.Errorf("private topics should differ, both of them %s", t1)
+	}
+	if !strings.HasPrefix(t1, "response.") {
+		t.Errorf("private topic should start with the base, instead of %s", t1)
+	}
+	if !nsq.IsValidTopicName(t1) {
+		t.Errorf("%s should be a valid topic name", t1)
+	}
+}
+
+func TestPrivateTopicLongBase(t *testing.T) {
+	topic := PrivateTopic(strings.Repeat("r", maxNameLength))
+
+	if len(topic) > maxNameLength {
+		t.Errorf("private topic should be at most %d long, instead of %d", maxNameLength, len(topic))
+	}
+	if !nsq.IsValidTopicName(topic) {
+		t.Errorf("%s should be a valid topic name", topic)
+	}
+}
+
+func TestEphemeralChannel(t *testing.T) {
+	if ch := EphemeralChannel("client"); ch != "client#ephemeral" {
+		t.Errorf("channel should be client#ephemeral, instead of %s", ch)
+	}
+	if ch := EphemeralChannel("client#ephemeral"); ch != "client#ephemeral" {
+		t.Errorf("channel should be client#ephemeral, instead of %s", ch)
+	}
+	if !nsq.IsValidChannelName(EphemeralChannel(strings.Repeat("c", maxNameLength))) {
+		t.Error("long channel name should be truncated")
+	}
+}
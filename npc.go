@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,6 +13,15 @@ import (
 	"github.com/PumpkinSeed/npc/lib/consumer"
 	"github.com/PumpkinSeed/npc/lib/producer"
 	"github.com/PumpkinSeed/npc/lib/rpc"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+var (
+	// ErrNotStarted returned by Close if the client wasn't started
+	ErrNotStarted = errors.New("client not started")
+
+	// defaultTimeout used by the Publish method
+	defaultTimeout = time.Minute
 )
 
 // T the type of the npc
@@ -31,9 +41,25 @@ const (
 // reqTopic determine the request topic name
 // logger stores the nsq inner logger
 // err stores the errors occured in the setup and return at the end of the setup
+// compression is the threshold of the body compression
+// skew is the tolerated clock difference between the clients and the server
 // channel stores the name of the channel for the topics
-// rspTopic define the response topic for the client
+// rspTopic define the response topic for the client, by default it's
+// just the base of the private reply topics, with nsqlookupd it's consumed
+// on private channels
+// sharedReplies true if all the client instances consume the rspTopic itself
+// conn stores the long-lived client connections created by Start
+// codec encodes and decodes the bodies of the typed calls
+// format is the wire format of the client requests
+// clientInterceptors wrap every call of the client
+// retryPolicies stores the retry policies of the client by method
+// noCancel turns off the cancel messages of the client
 // app stores the server related AppServer
+// serverInterceptors wrap the app
+// dedup stores the replies of the served requests
+// replyRequired are the methods which can't be notified
+// deadLetterTopic gets the requests which can't be served
+// maxAttempts is the number of deliveries before a request is dead
 // interruptor stores the function called at the end of the server to handle custom interruption
 // customInterruptor boolean true if custum interruption setted up
 type Main struct {
@@ -41,20 +67,35 @@ type Main struct {
 	client bool
 
 	// Common data for both handler
-	p        *producer.Config
-	c        *consumer.Config
-	reqTopic string
-	logger   common.Logger
-	err      error
-	channel  string
+	p           *producer.Config
+	c           *consumer.Config
+	reqTopic    string
+	logger      common.Logger
+	err         error
+	channel     string
+	compression int
+	skew        time.Duration
 
 	// Client related data
-	rspTopic string
+	rspTopic           string
+	sharedReplies      bool
+	conn               *clientConn
+	connMu             sync.RWMutex
+	codec              rpc.Codec
+	format             rpc.Format
+	clientInterceptors []rpc.ClientInterceptor
+	retryPolicies      map[string]rpc.RetryPolicy
+	noCancel           bool
 
 	// Server releated data
-	app               rpc.AppServer
-	interruptor       func()
-	customInterruptor bool
+	app                rpc.AppServer
+	serverInterceptors []rpc.ServerInterceptor
+	dedup              rpc.DedupStore
+	replyRequired      []string
+	deadLetterTopic    string
+	maxAttempts        uint16
+	interruptor        func()
+	customInterruptor  bool
 }
 
 // New creates a new instance of the Main handler based on the type
@@ -91,6 +132,14 @@ func (m *Main) Init(p *producer.Config, c *consumer.Config, rt string, channel s
 	return m
 }
 
+// SetCompression turns on the snappy compression of the request bodies
+// on the client and the reply bodies on the server side, if they are at
+// least threshold bytes long, zero turns it off
+// the peers must be up to date to decompress them
+func (m *Main) SetCompression(threshold int) {
+	m.compression = threshold
+}
+
 /*
 	Server related methods
 */
@@ -122,6 +171,18 @@ func (m *Main) Listen() error {
 	// rpc server: accepts request, calls application, sends response
 	ctx, cancel := context.WithCancel(context.Background())
 	rpcServer := rpc.NewServer(ctx, m.app, p)
+	rpcServer.SetCompression(m.compression)
+	rpcServer.SetClockSkew(m.skew)
+	rpcServer.Use(m.serverInterceptors...)
+	rpcServer.SetDedupStore(m.dedup)
+	rpcServer.SetReplyRequired(m.replyRequired...)
+	rpcServer.SetDeadLetter(m.deadLetterTopic, m.maxAttempts)
+	rpcServer.SetLogger(m.c.Logger)
+
+	// the frames of the client streams arrive on the private topic of
+	// the server instance, which accepted the stream
+	streamTopic := rpc.PrivateTopic(m.reqTopic)
+	rpcServer.SetStreamTopic(streamTopic)
 
 	c, err := consumer.New(m.c, m.reqTopic, m.channel, rpcServer)
 	if err != nil {
@@ -129,10 +190,29 @@ func (m *Main) Listen() error {
 		return err
 	}
 
+	// every server instance gets all the cancellations of the clients on
+	// its own channel, it cancels the ones it's working on
+	cc, err := consumer.New(m.c, rpc.ControlTopic(m.reqTopic), rpc.PrivateChannel(m.channel), rpcServer)
+	if err != nil {
+		c.Stop()
+		cancel()
+		return err
+	}
+
+	sc, err := consumer.New(m.c, streamTopic, rpc.EphemeralChannel(m.channel), rpcServer.StreamHandler())
+	if err != nil {
+		cc.Stop()
+		c.Stop()
+		cancel()
+		return err
+	}
+
 	// clean exit
-	defer p.Stop() // 3. stop response producer
-	defer cancel() // 2. cancel any pending operation (returns unfinished messages to nsq)
-	defer c.Stop() // 1. stop accepting new requestser.Stop() // 1. stop accepting new requests
+	defer p.Stop()  // 3. stop response producer
+	defer cancel()  // 2. cancel any pending operation (returns unfinished messages to nsq)
+	defer c.Stop()  // 1. stop accepting new requestser.Stop() // 1. stop accepting new requests
+	defer cc.Stop() // 0. stop accepting the cancellations
+	defer sc.Stop() //    and the frames of the client streams
 
 	if m.customInterruptor {
 		m.interruptor()
@@ -143,6 +223,39 @@ func (m *Main) Listen() error {
 	return nil
 }
 
+// SetClockSkew sets the tolerated clock difference between the clients
+// and the server, the requests expire that much later on the server
+func (m *Main) SetClockSkew(skew time.Duration) {
+	m.skew = skew
+}
+
+// SetServerInterceptors sets the chain wrapping the app, the first
+// interceptor is the outermost, it must be called before Listen
+func (m *Main) SetServerInterceptors(interceptors ...rpc.ServerInterceptor) {
+	m.serverInterceptors = interceptors
+}
+
+// SetDedupStore sets the store of the served requests, so the duplicated
+// requests get the stored reply instead of serving them again
+func (m *Main) SetDedupStore(store rpc.DedupStore) {
+	m.dedup = store
+}
+
+// SetReplyRequired sets the methods which can't be notified, the
+// notifications of them are dropped
+func (m *Main) SetReplyRequired(methods ...string) {
+	m.replyRequired = methods
+}
+
+// SetDeadLetter sets the topic where the undecodable, expired and
+// exhausted requests are republished, maxAttempts is the number of
+// deliveries before a request is exhausted, zero leaves it to the
+// MaxAttempts of the consumer
+func (m *Main) SetDeadLetter(topic string, maxAttempts uint16) {
+	m.deadLetterTopic = topic
+	m.maxAttempts = maxAttempts
+}
+
 // SetInterruptor setup a custom interruptor
 func (m *Main) SetInterruptor(i func()) {
 	m.customInterruptor = true
@@ -154,7 +267,8 @@ func (m *Main) SetInterruptor(i func()) {
 */
 
 // Client do the setup for client kind of handler
-// it waits for a response topic name as parameter
+// it waits for a response topic name as parameter, the replies arrive
+// on private topics derived from it unless SetSharedReplyTopic
 func (m *Main) Client(rt string) (*Main, error) {
 	if m.server {
 		return nil, errors.New("server can't act as a client")
@@ -165,44 +279,436 @@ func (m *Main) Client(rt string) (*Main, error) {
 	return m, m.err
 }
 
+// SetSharedReplyTopic turns off the private reply topics, all the client
+// instances consume the response topic itself on the same channel
+// it's only safe with a single client instance
+func (m *Main) SetSharedReplyTopic(shared bool) {
+	m.sharedReplies = shared
+}
+
+// SetFormat sets the wire format of the client requests, the server
+// replies in the same format, the binary one needs up to date servers
+func (m *Main) SetFormat(f rpc.Format) {
+	m.format = f
+}
+
+// SetClientInterceptors sets the chain wrapping every call, the calls
+// which don't wait for the reply inside the chain pass nil reply to it,
+// the first interceptor is the outermost, it must be called before Start
+func (m *Main) SetClientInterceptors(interceptors ...rpc.ClientInterceptor) {
+	m.clientInterceptors = interceptors
+}
+
+// SetRetryPolicy sets the retry policy of the method, the policy of the
+// empty method is the default for all the others, it must be called
+// before Start
+func (m *Main) SetRetryPolicy(method string, p rpc.RetryPolicy) {
+	if m.retryPolicies == nil {
+		m.retryPolicies = make(map[string]rpc.RetryPolicy)
+	}
+	m.retryPolicies[method] = p
+}
+
+// SetCancellation turns on or off the cancel messages sent to the servers
+// when the context of a call is cancelled, on by default
+func (m *Main) SetCancellation(enabled bool) {
+	m.noCancel = !enabled
+}
+
+// Start opens the long-lived connections of the client, after that every
+// Publish reuses the same producer, response consumer and rpc client
+// instead of building them on every single call
+func (m *Main) Start() error {
+	if m.server {
+		return errors.New("server can't act as a client")
+	}
+	if m.err != nil {
+		return m.err
+	}
+
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if m.conn != nil {
+		return errors.New("client already started")
+	}
+
+	conn, err := m.dial(true)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+
+	return nil
+}
+
+// Close waits for the pending calls of the started client and
+// closes the long-lived connections
+func (m *Main) Close() error {
+	m.connMu.Lock()
+	conn := m.conn
+	m.conn = nil
+	m.connMu.Unlock()
+
+	if conn == nil {
+		return ErrNotStarted
+	}
+
+	conn.close()
+	return nil
+}
+
 // Publish a message to the nsq and waits for the server response
 // through the response topic
 // the first parameter is the resource what it want to reach from the
 // AppServer and the second is the exact message
 func (m *Main) Publish(typ string, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	return m.PublishContext(ctx, typ, msg)
+}
+
+// PublishContext is the same as Publish, but the deadline and the
+// cancellation of the call comes from the ctx
+// the error of the server returned as *rpc.Status
+func (m *Main) PublishContext(ctx context.Context, typ string, msg []byte) ([]byte, error) {
 	if m.server {
 		return nil, errors.New("server can't act as a client")
 	}
 
-	var err error
+	return m.call(ctx, typ, msg)
+}
 
-	p, err := producer.New(m.p)
+// SetCodec replaces the default JSON codec of the typed calls
+func (m *Main) SetCodec(c rpc.Codec) {
+	m.codec = c
+}
 
-	// rpc client: sends requests, waits and accepts responses
-	//             provides interface for application
-	rpcClient := rpc.NewClient(p, m.reqTopic, m.rspTopic)
+// Call is the typed version of the PublishContext, the req encoded by the
+// codec as request body and the response body decoded into the rsp,
+// which should be a pointer, the error of the server returned as error
+func (m *Main) Call(ctx context.Context, typ string, req interface{}, rsp interface{}) error {
+	if m.server {
+		return errors.New("server can't act as a client")
+	}
+
+	codec := m.codec
+	if codec == nil {
+		codec = rpc.JSONCodec{}
+	}
+
+	return rpc.Invoke(ctx, m.Caller(), codec, typ, req, rsp)
+}
+
+// Caller returns the client as rpc.Caller, the clients generated by the
+// protoc-gen-npc are built on top of it
+func (m *Main) Caller() rpc.Caller {
+	return rpc.CallerFunc(m.call)
+}
 
-	c, err := consumer.New(m.c, m.rspTopic, m.channel, rpcClient)
+// call sends the request through the started client, or through
+// a temporary one if the client wasn't started
+func (m *Main) call(ctx context.Context, typ string, msg []byte) ([]byte, error) {
+	conn, release, err := m.acquire()
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	return conn.client.Do(ctx, typ, msg)
+}
 
-	// clean exit
-	defer p.Stop() // 3. stop producing new requests
-	defer cancel() // 2. cancel any pending (waiting for responses)
-	defer c.Stop() // 1. stop listening for responses
+// Notify sends a one-way message to the method, it doesn't wait for any
+// reply, it returns after the message published, without started client
+// only a producer is created for it
+func (m *Main) Notify(ctx context.Context, typ string, msg []byte) error {
+	if m.server {
+		return errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquireNotifier()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return conn.client.Notify(ctx, typ, msg)
+}
+
+// NotifyAfter sends a one-way message to the method, which is delivered
+// after the delay by nsqd, it returns after the message published
+func (m *Main) NotifyAfter(ctx context.Context, delay time.Duration, typ string, msg []byte) error {
+	if m.server {
+		return errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquireNotifier()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return conn.client.NotifyAfter(ctx, delay, typ, msg)
+}
+
+// Go calls the method asynchronously, the Done channel of the returned
+// call receives it when it's done, if done is nil a new channel is
+// allocated, otherwise it must be buffered
+func (m *Main) Go(ctx context.Context, typ string, msg []byte, done chan *rpc.Call) *rpc.Call {
+	return m.GoAfter(ctx, 0, typ, msg, done)
+}
+
+// GoAfter calls the method asynchronously after the delay, the timeout of
+// the context starts after the delay, the Done channel of the returned
+// call receives it when it's done
+func (m *Main) GoAfter(ctx context.Context, delay time.Duration, typ string, msg []byte, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	} else if cap(done) == 0 {
+		panic("npc: done channel is unbuffered")
+	}
 
-	rspBody, rspErr, err := rpcClient.Call(ctx, typ, msg)
+	// the call of the client is copied into the returned one, so the
+	// connection can be released before it's signalled
+	call := &rpc.Call{Method: typ, Request: msg, Done: done}
+	m.goFunc(ctx, delay, call, func(c *rpc.Call) {
+		call.Reply, call.Header, call.Error = c.Reply, c.Header, c.Error
+		select {
+		case call.Done <- call:
+		default:
+		}
+	})
+	return call
+}
+
+// GoFunc calls the method asynchronously, the callback is called with the
+// call when it's done, it must not block
+func (m *Main) GoFunc(ctx context.Context, typ string, msg []byte, callback func(*rpc.Call)) {
+	m.goFunc(ctx, 0, &rpc.Call{Method: typ, Request: msg}, callback)
+}
+
+// goFunc starts the call on the connection, it's released when the call
+// is done, so a scheduled call keeps it until the delay and the reply
+func (m *Main) goFunc(ctx context.Context, delay time.Duration, call *rpc.Call, callback func(*rpc.Call)) {
+	if m.server {
+		call.Error = errors.New("server can't act as a client")
+		callback(call)
+		return
+	}
+
+	conn, release, err := m.acquire()
+	if err != nil {
+		call.Error = err
+		callback(call)
+		return
+	}
+
+	// the callback runs on the consumer of the connection, closing a
+	// temporary connection there would wait for itself
+	conn.client.GoFuncAfter(ctx, delay, call.Method, call.Request, func(c *rpc.Call) {
+		go release()
+		callback(c)
+	})
+}
+
+// Batch sends the calls with as few publishes as possible and waits until
+// all of them are done, the replies and the errors are in the calls
+func (m *Main) Batch(ctx context.Context, calls []*rpc.Call) error {
+	if m.server {
+		return errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	conn.client.Batch(ctx, calls)
+	return nil
+}
+
+// Broadcast sends the request once to all the server groups consuming the
+// request topic on different channels and collects their replies, until
+// the count or the quorum of the options reached or the deadline
+func (m *Main) Broadcast(ctx context.Context, typ string, msg []byte, opts rpc.BroadcastOptions) ([]*rpc.Envelope, error) {
+	if m.server {
+		return nil, errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return conn.client.Broadcast(ctx, typ, msg, opts)
+}
+
+// Stream calls the method with streamed reply, the stream must be read
+// until the end or closed
+func (m *Main) Stream(ctx context.Context, typ string, msg []byte) (*rpc.ClientStream, error) {
+	if m.server {
+		return nil, errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := conn.client.Stream(ctx, typ, msg)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// the connection is in use until the end of the stream
+	go func() {
+		<-s.Done()
+		release()
+	}()
+
+	return s, nil
+}
+
+// OpenStream opens a client stream or a bidirectional stream to the
+// method, the stream must be read until the end or closed
+func (m *Main) OpenStream(ctx context.Context, typ string) (*rpc.ClientStream, error) {
+	if m.server {
+		return nil, errors.New("server can't act as a client")
+	}
+
+	conn, release, err := m.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := conn.client.OpenStream(ctx, typ)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// the connection is in use until the end of the stream
+	go func() {
+		<-s.Done()
+		release()
+	}()
+
+	return s, nil
+}
+
+// acquire returns the long-lived connection if the client is started,
+// otherwise a temporary one, release must be called after it's used
+func (m *Main) acquire() (*clientConn, func(), error) {
+	return m.acquireConn(true)
+}
+
+// acquireNotifier is the same as the acquire, but the temporary connection
+// has only producer, the notifications don't need reply topic
+func (m *Main) acquireNotifier() (*clientConn, func(), error) {
+	return m.acquireConn(false)
+}
+
+// acquireConn returns the started connection or dials a temporary one
+func (m *Main) acquireConn(replies bool) (*clientConn, func(), error) {
+	m.connMu.RLock()
+	conn := m.conn
+	if conn != nil {
+		// register the call while holding the lock, so Close
+		// can't miss it
+		conn.pending.Add(1)
+	}
+	m.connMu.RUnlock()
+
+	if conn != nil {
+		return conn, conn.pending.Done, nil
+	}
+
+	conn, err := m.dial(replies)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, conn.close, nil
+}
+
+// replyTopic returns the reply topic and the channel of a connection
+// every connection gets its own ephemeral reply topic derived from the
+// response topic, so replies never load-balanced to an other instance
+// with nsqlookupd a new topic would be found only at the next poll, so the
+// connection consumes the response topic on its own ephemeral channel
+// instead, every instance gets all the replies and drops the others'
+func (m *Main) replyTopic() (string, string) {
+	switch {
+	case m.sharedReplies:
+		return m.rspTopic, m.channel
+	case len(m.c.NSQLookupdAddresses) > 0:
+		return m.rspTopic, rpc.PrivateChannel(m.channel)
+	}
+	return rpc.PrivateTopic(m.rspTopic), rpc.EphemeralChannel(m.channel)
+}
+
+// dial creates the producer, the rpc client and the consumer of the
+// response topic, without replies there is no response topic and consumer
+func (m *Main) dial(replies bool) (*clientConn, error) {
+	rspTopic, channel := m.replyTopic()
+	if !replies {
+		rspTopic = ""
+	}
+
+	p, err := producer.New(m.p)
 	if err != nil {
 		return nil, err
 	}
-	if rspErr != "" {
-		return nil, errors.New(rspErr)
+
+	// rpc client: sends requests, waits and accepts responses
+	//             provides interface for application
+	rpcClient := rpc.NewClient(p, m.reqTopic, rspTopic)
+	rpcClient.SetFormat(m.format)
+	rpcClient.SetCompression(m.compression)
+	rpcClient.Use(m.clientInterceptors...)
+	rpcClient.SetCancellation(!m.noCancel)
+	rpcClient.SetSharedReplyTopic(rspTopic == m.rspTopic)
+	for method, policy := range m.retryPolicies {
+		rpcClient.SetRetryPolicy(method, policy)
+	}
+
+	conn := &clientConn{producer: p, client: rpcClient}
+	if !replies {
+		return conn, nil
+	}
+
+	c, err := consumer.New(m.c, rspTopic, channel, rpcClient)
+	if err != nil {
+		p.Stop()
+		return nil, err
 	}
+	conn.consumer = c
 
-	return rspBody, nil
+	return conn, nil
+}
+
+// clientConn holds the connections used by the client side
+// pending counts the calls still waiting for their responses
+type clientConn struct {
+	producer *nsq.Producer
+	consumer *nsq.Consumer
+	client   *rpc.Client
+	pending  sync.WaitGroup
+}
+
+// close waits for the pending calls and stops the connections
+func (cc *clientConn) close() {
+	// clean exit
+	cc.pending.Wait() // 1. let the pending calls get their responses
+	if cc.consumer != nil {
+		cc.consumer.Stop() // 2. stop listening for responses
+		<-cc.consumer.StopChan
+	}
+	cc.producer.Stop() // 3. stop producing new requests
 }
 
 // DefaultInterupt is the default one and waits for a Ctrl+C
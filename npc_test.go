@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/PumpkinSeed/npc/lib/common"
 	"github.com/PumpkinSeed/npc/lib/consumer"
@@ -57,6 +59,20 @@ func c(t *testing.T) {
 
 	fmt.Println(string(resp))
 
+	var rsp struct {
+		Z int
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err = m.Call(ctx, "Add", struct{ X, Y int }{1, 2}, &rsp)
+	if err != nil {
+		t.Error(err)
+	}
+	if rsp.Z != 12 {
+		t.Errorf("Z should be 12, instead of %d", rsp.Z)
+	}
+
 	wg.Done()
 }
 
@@ -116,3 +132,56 @@ func (a *app) Serve(ctx context.Context, method string, reqBuf []byte) ([]byte,
 		return nil, nil
 	}
 }
+
+func TestDialNotifier(t *testing.T) {
+	pConf := &producer.Config{
+		NSQConfig:   nsq.NewConfig(),
+		NSQDAddress: localNSQd,
+		Logger:      l,
+		LogLevel:    nsq.LogLevelInfo,
+	}
+	cConf := &consumer.Config{
+		NSQConfig:   nsq.NewConfig(),
+		NSQDAddress: localNSQd,
+		Logger:      l,
+		LogLevel:    nsq.LogLevelInfo,
+	}
+
+	m, err := New(Client).
+		Init(pConf, cConf, "request", "server", l).
+		Client("response")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the notifications need neither reply topic nor consumer
+	conn, release, err := m.acquireNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if conn.consumer != nil {
+		t.Error("notifier shouldn't consume a reply topic")
+	}
+}
+
+func TestReplyTopic(t *testing.T) {
+	m := New(Client)
+	m.c = &consumer.Config{}
+	m.rspTopic, m.channel = "response", "client"
+
+	if topic, channel := m.replyTopic(); !strings.HasPrefix(topic, "response.") || channel != "client#ephemeral" {
+		t.Errorf("reply topic should be private, instead of %s %s", topic, channel)
+	}
+
+	// the private topics wouldn't be found by the lookupd in time
+	m.c.NSQLookupdAddresses = []string{"127.0.0.1:4161"}
+	if topic, channel := m.replyTopic(); topic != "response" || !strings.HasPrefix(channel, "client.") {
+		t.Errorf("reply channel should be private, instead of %s %s", topic, channel)
+	}
+
+	m.SetSharedReplyTopic(true)
+	if topic, channel := m.replyTopic(); topic != "response" || channel != "client" {
+		t.Errorf("reply topic should be shared, instead of %s %s", topic, channel)
+	}
+}